@@ -0,0 +1,207 @@
+package zammadbridge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// dialRequest asks the bridge to let the phone of an agent call a number.
+type dialRequest struct {
+	Extension string `json:"extension"`
+	Number    string `json:"number"`
+}
+
+// serveAPI serves the HTTP API of the bridge, which offers click-to-dial, the ongoing calls and the call history. It
+// does not return unless the server stops.
+func (z *ZammadBridge) serveAPI() error {
+	if z.Config.Bridge.ApiSecret == "" {
+		return fmt.Errorf("refusing to serve the API without api_secret")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /dial", z.authenticated(z.handleDial))
+	mux.HandleFunc("GET /calls", z.authenticated(z.handleCalls))
+	mux.HandleFunc("GET /history", z.authenticated(z.handleHistory))
+	// Linked recordings are opened by Zammad agents, so the link itself carries the signature
+	mux.HandleFunc("GET /recordings/{id}", z.handleRecording)
+
+	server := &http.Server{
+		Addr:              z.Config.Bridge.ApiListen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Info().Str("listen", z.Config.Bridge.ApiListen).Msg("Serving bridge API")
+	return server.ListenAndServe()
+}
+
+// authenticated only lets requests through that present the shared secret, either as bearer token or in the
+// X-Bridge-Secret header.
+func (z *ZammadBridge) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get("X-Bridge-Secret")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			secret = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		configMu.RLock()
+		expected := z.Config.Bridge.ApiSecret
+		configMu.RUnlock()
+
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) != 1 {
+			log.Warn().Str("remote", r.RemoteAddr).Str("path", r.URL.Path).Msg("Rejected unauthenticated API request")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// handleDial places a call from the extension of an agent to the requested number. The request is either JSON or
+// a form with the fields "extension" and "number". The call itself is picked up by the regular polling.
+func (z *ZammadBridge) handleDial(w http.ResponseWriter, r *http.Request) {
+	var req dialRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+		if err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Extension = r.FormValue("extension")
+		req.Number = r.FormValue("number")
+	}
+
+	req.Extension = strings.TrimSpace(req.Extension)
+	req.Number = strings.Map(func(r rune) rune {
+		if r == '+' || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, req.Number)
+
+	if req.Extension == "" || req.Number == "" {
+		http.Error(w, "extension and number are required", http.StatusBadRequest)
+		return
+	}
+
+	// Only the phones of the monitored extensions may dial, not e.g. trunks or queues
+	configMu.RLock()
+	extensionDigits := z.Config.Phone3CX.ExtensionDigits
+	configMu.RUnlock()
+
+	if len(req.Extension) != extensionDigits || !z.Client3CX.IsExtension(req.Extension) {
+		log.Warn().Str("remote", r.RemoteAddr).Str("extension", req.Extension).Msg("Rejected dialing from an unknown extension")
+		http.Error(w, "extension is not a monitored extension", http.StatusBadRequest)
+		return
+	}
+
+	log.Info().Str("extension", req.Extension).Str("number", req.Number).Msg("Dialing on behalf of agent")
+
+	err := z.Client3CX.MakeCall(req.Extension, req.Number)
+	if errors.Is(err, ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("extension", req.Extension).Str("number", req.Number).Msg("Unable to dial")
+		http.Error(w, "unable to dial", http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleRecording passes on a recording from 3CX, if the request is signed, see RecordingSink.link.
+func (z *ZammadBridge) handleRecording(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid recording", http.StatusBadRequest)
+		return
+	}
+
+	configMu.RLock()
+	expected := recordingSignature(z.Config.Bridge.ApiSecret, id)
+	configMu.RUnlock()
+
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("sig")), []byte(expected)) != 1 {
+		log.Warn().Str("remote", r.RemoteAddr).Int("recording", id).Msg("Rejected unsigned recording request")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := z.Client3CX.OpenRecording(&Recording{ID: id})
+	if errors.Is(err, ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Int("recording", id).Msg("Unable to download recording")
+		http.Error(w, "unable to download recording", http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="recording-%d.wav"`, id))
+	_, _ = io.Copy(w, body)
+}
+
+// handleCalls lists the calls that are currently ongoing.
+func (z *ZammadBridge) handleCalls(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(z.Calls())
+}
+
+// handleHistory lists the finished calls from the call history. The query parameters "from" and "to" (RFC 3339),
+// "agent", "number" and "missed" filter them, see HistoryFilter.
+func (z *ZammadBridge) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if z.history == nil {
+		http.Error(w, "no history_file configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := HistoryFilter{
+		Agent:      query.Get("agent"),
+		Number:     query.Get("number"),
+		MissedOnly: query.Get("missed") == "true",
+	}
+
+	var err error
+	for name, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if query.Get(name) == "" {
+			continue
+		}
+
+		*t, err = time.Parse(time.RFC3339Nano, query.Get(name))
+		if err != nil {
+			http.Error(w, "invalid "+name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := z.history.Query(filter)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read call history")
+		http.Error(w, "unable to read call history", http.StatusInternalServerError)
+		return
+	}
+
+	if records == nil {
+		records = []HistoryRecord{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(records)
+}
@@ -0,0 +1,57 @@
+package zammadbridge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// dialStub3CX knows extension 150, and records the calls it is asked to make.
+type dialStub3CX struct {
+	API3CX
+
+	dialed []string
+}
+
+func (d *dialStub3CX) IsExtension(number string) bool {
+	return number == "150"
+}
+
+func (d *dialStub3CX) MakeCall(extension string, destination string) error {
+	d.dialed = append(d.dialed, extension+">"+destination)
+	return nil
+}
+
+func TestDialExtension(t *testing.T) {
+	tests := []struct {
+		extension string
+		status    int
+	}{
+		{"150", http.StatusAccepted},
+		{"151", http.StatusBadRequest},   // not monitored
+		{"10007", http.StatusBadRequest}, // a trunk
+		{"15", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		config := &Config{}
+		config.Phone3CX.ExtensionDigits = 3
+		client := &dialStub3CX{}
+		z := &ZammadBridge{Config: config, Client3CX: client}
+
+		form := url.Values{"extension": {tt.extension}, "number": {"+49 123 456789"}}
+		req := httptest.NewRequest(http.MethodPost, "/dial", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		z.handleDial(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("extension %s: expected HTTP %d, got %d", tt.extension, tt.status, rec.Code)
+		}
+		if dialed := len(client.dialed) > 0; dialed != (tt.status == http.StatusAccepted) {
+			t.Errorf("extension %s: dialed %v", tt.extension, client.dialed)
+		}
+	}
+}
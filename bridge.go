@@ -3,9 +3,12 @@ package zammadbridge
 import (
 	"encoding/json"
 	"fmt"
-	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,30 +18,133 @@ import (
 type ZammadBridge struct {
 	Config *Config
 
-	Client3CX    API3CX
-	ClientZammad http.Client
+	Client3CX API3CX
 
-	ongoingCalls map[json.Number]CallInformation
+	// Sinks receive the events of all calls, e.g. Zammad.
+	Sinks []CallEventSink
+
+	// mu guards ongoingCalls and everything reachable from it, as well as the outbox, state and history below. It is
+	// held while calls are processed, such that calls reported by several sources at once are processed one by one.
+	// Readers use the snapshot accessors, e.g. Calls.
+	mu           sync.RWMutex
+	ongoingCalls map[json.Number]*callLifecycle
+
+	// outbox holds the events that are waiting for the sinks. They are delivered after mu is released, one goroutine
+	// at a time as guarded by deliverMu, such that the sinks do not block the readers, and the events of each call
+	// reach the sinks in order. deliverMu also guards the sinks themselves, see deliverEvents.
+	outbox    []callEvent
+	deliverMu sync.Mutex
+
+	// state persists the ongoing calls, if configured. stateChanged tells whether calls were removed since the
+	// last save, while changes of the calls themselves are tracked by each callLifecycle.
+	state        *stateFile
+	stateChanged bool
+
+	// history records the finished calls, if configured.
+	history *History
+
+	// now replaces time.Now, e.g. to replay recorded traffic, see clock.
+	now func() time.Time
 }
 
 // NewZammadBridge initializes a new client that listens for 3CX calls and forwards to Zammad.
 func NewZammadBridge(config *Config) (*ZammadBridge, error) {
-	client3CX, err := Create3CXClient(config)
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var journal *Journal
+	if config.Journal.Directory != "" {
+		journal, err = NewJournal(config.Journal)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create journal: %w", err)
+		}
+	}
+
+	zammad, err := NewZammadClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Zammad client: %w", err)
+	}
+	zammad.journal = journal
+
+	client3CX, err := Create3CXClient(config, journal)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create 3CX client: %w", err)
 	}
 
-	return &ZammadBridge{
+	sinks, err := newSinks(config, zammad, client3CX)
+	if err != nil {
+		return nil, err
+	}
+
+	z := &ZammadBridge{
 		Config:       config,
 		Client3CX:    client3CX,
-		ongoingCalls: map[json.Number]CallInformation{},
-	}, nil
+		Sinks:        sinks,
+		ongoingCalls: map[json.Number]*callLifecycle{},
+	}
+
+	if config.Bridge.StateFile != "" {
+		z.state = &stateFile{path: config.Bridge.StateFile}
+	}
+
+	if config.Bridge.HistoryFile != "" {
+		z.history, err = OpenHistory(config.Bridge.HistoryFile, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return z, nil
+}
+
+// newSinks creates the sinks that are notified about calls: Zammad, the webhooks and the recordings, if enabled.
+func newSinks(config *Config, zammad *ZammadClient, client3CX API3CX) ([]CallEventSink, error) {
+	sinks := []CallEventSink{zammad}
+	for _, w := range config.Webhooks {
+		webhook, err := NewWebhookSink(w)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create webhook: %w", err)
+		}
+		sinks = append(sinks, webhook)
+	}
+
+	if config.Recordings.Enabled {
+		sinks = append(sinks, NewRecordingSink(config.Recordings, client3CX, zammad))
+	}
+
+	return sinks, nil
 }
 
 // Listen listens for calls and does not return unless something really bad happened.
 func (z *ZammadBridge) Listen() error {
 	log.Info().Msg("Starting 3CX-Zammad bridge (fetching calls every " + strconv.FormatFloat(z.Config.Bridge.PollInterval, 'f', -1, 64) + " seconds)")
+
+	err := z.reconcile()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to reconcile calls from the previous run")
+	}
+
+	if z.Config.Bridge.ApiListen != "" {
+		go func() {
+			err := z.serveAPI()
+			log.Error().Err(err).Msg("Bridge API stopped")
+		}()
+	}
+
+	// The configuration is reloaded on SIGHUP, or when its files change
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
 	for {
+		if reason, ok := z.reloadRequested(hup); ok {
+			z.reload(reason)
+		}
+
+		z.refreshSecrets()
+
 		err := z.RequestAndProcess()
 		if err != nil && (strings.Contains(err.Error(), "401") || strings.Contains(err.Error(), "403")) {
 			log.Trace().Err(err).Msg("Reconnecting due to authentication error")
@@ -57,73 +163,71 @@ func (z *ZammadBridge) Listen() error {
 	}
 }
 
-// isDuplicateCall takes care of some edge cases where the same call is reported multiple times.
-// More specifically, when it is reported as "Talking" to the queue and "Rinning" to the agent.
-// This function should return true if the call is a duplicate and should be ignored. Which is
-// the case for the "Ringing" to the agent, such that the "Talking" to the queue is handled.
-func (z *ZammadBridge) isDuplicateCall(call CallInformation, calls []CallInformation) bool {
-	if call.Status != "Ringing" {
-		return false
+// RequestAndProcess requests the current calls from 3CX and processes them to Zammad
+func (z *ZammadBridge) RequestAndProcess() error {
+	calls, err := z.Client3CX.FetchCalls()
+	if err != nil {
+		// Without a complete list of calls, no call may be considered ended
+		return err
 	}
 
-	for _, possibleQueueCall := range calls {
-		if possibleQueueCall.ID == call.ID && possibleQueueCall.Status == "Talking" && z.isCallToQueue(possibleQueueCall) {
-			return true
-		}
-	}
+	// The events are delivered once the calls are processed and the lock is released
+	defer z.deliverEvents()
 
-	return false
-}
+	z.mu.Lock()
+	defer z.mu.Unlock()
 
-// RequestAndProcess requests the current calls from 3CX and processes them to Zammad
-func (z *ZammadBridge) RequestAndProcess() error {
-	calls, err := z.Client3CX.FetchCalls()
-	newCalls := make([]json.Number, 0, len(calls))
+	// 3CX reports every leg of a call separately (e.g. the queue and the agents), so they are grouped by call first
+	var callIds []json.Number
+	legs := map[json.Number][]CallInformation{}
 	for _, c := range calls {
-		if z.isDuplicateCall(c, calls) {
-			continue
+		if _, ok := legs[c.ID]; !ok {
+			callIds = append(callIds, c.ID)
+			legs[c.ID] = nil
 		}
 
-		err = z.ProcessCall(&c)
-		if err != nil {
-			log.Error().Err(err).Msg("Error processing call")
+		if z.classifyCall(&c) {
+			legs[c.ID] = append(legs[c.ID], c)
 		}
+	}
 
-		newCalls = append(newCalls, c.ID)
+	for _, callId := range callIds {
+		if len(legs[callId]) > 0 {
+			z.processLegs(legs[callId])
+		}
 	}
 
 	var endedCalls []json.Number
-
-endedCallLoop:
-	for callId, oldInfo := range z.ongoingCalls {
+	for callId, l := range z.ongoingCalls {
 		// Check if call is still ongoing
-		for _, newCallId := range newCalls {
-			if newCallId == callId {
-				continue endedCallLoop
+		if _, ok := legs[callId]; ok {
+			if l.MissedPolls > 0 {
+				log.Debug().Str("call_id", l.Call.CallUID).Int("missed_polls", l.MissedPolls).Msg("Call is reported again by 3CX")
+				l.MissedPolls = 0
+				l.MissingSince = time.Time{}
+				l.changed = true
 			}
+			continue
+		}
+
+		if !z.callGone(l) {
+			continue
 		}
 
 		// Apparently, the call has ended, because 3CX does not report it any longer
-		log.Trace().Str("call_id", oldInfo.CallUID).Str("direction", oldInfo.Direction).Str("from", oldInfo.CallFrom).Str("to", oldInfo.CallTo).Msg("Call ended (no longer reported by 3CX)")
+		log.Trace().Str("call_id", l.Call.CallUID).Str("direction", l.Call.Direction).Str("from", l.Call.CallFrom).Str("to", l.Call.CallTo).Msg("Call ended (no longer reported by 3CX)")
 		endedCalls = append(endedCalls, callId)
-		if oldInfo.Status == "Routing" {
-			log.Info().Str("call_id", oldInfo.CallUID).Str("direction", oldInfo.Direction).Str("from", oldInfo.CallFrom).Str("to", oldInfo.CallTo).Msg("Call ended (hangup from routing)")
-			z.LogIfErr(z.ZammadHangup(&oldInfo, "cancel"), "hangup-from-routing")
-		} else if oldInfo.Status == "Talking" {
-			log.Info().Str("call_id", oldInfo.CallUID).Str("direction", oldInfo.Direction).Str("from", oldInfo.CallFrom).Str("to", oldInfo.CallTo).Msg("Call ended (hangup from talking)")
-			z.LogIfErr(z.ZammadHangup(&oldInfo, "normalClearing"), "hangup-from-talking")
-		} else if oldInfo.Status == "Transferring" && z.Config.Zammad.LogMissedQueueCalls {
-			log.Info().Str("call_id", oldInfo.CallUID).Str("direction", oldInfo.Direction).Str("from", oldInfo.CallFrom).Str("to", oldInfo.CallTo).Msg("Queue call was not answered")
-			oldInfo.AgentNumber = strconv.Itoa(z.Config.Phone3CX.QueueExtension)
-			z.LogIfErr(z.ZammadHangup(&oldInfo, "cancel"), "hangup-from-transferring")
-		}
+		z.endCall(l)
 	}
 
 	for _, callId := range endedCalls {
 		delete(z.ongoingCalls, callId)
+		z.stateChanged = true
 	}
 
-	return err
+	z.saveState()
+
+	return nil
 }
 
 // isCallToQueue checks if the call was to a queue instead of an agent
@@ -140,8 +244,24 @@ func (z *ZammadBridge) isCallToQueue(call CallInformation) bool {
 	return false
 }
 
-// ProcessCall processes a single ongoing call from 3CX
+// ProcessCall processes a single ongoing call from 3CX, which has a single leg. It is safe to call from any goroutine.
 func (z *ZammadBridge) ProcessCall(call *CallInformation) error {
+	defer z.deliverEvents()
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if z.classifyCall(call) {
+		z.processLegs([]CallInformation{*call})
+		z.saveState()
+	}
+
+	return nil
+}
+
+// classifyCall determines the direction, agent and external number of a leg of a call. It returns false if the leg
+// is not relevant, i.e. neither inbound nor outbound.
+func (z *ZammadBridge) classifyCall(call *CallInformation) bool {
 	if z.isOutboundCall(call) {
 		call.Direction = "Outbound"
 		call.AgentNumber = call.CallerNumber
@@ -158,37 +278,154 @@ func (z *ZammadBridge) ProcessCall(call *CallInformation) error {
 		call.CallFrom = call.ExternalNumber
 	} else {
 		log.Trace().Str("call_id", call.CallUID).Str("direction", call.Direction).Str("from", call.CallFrom).Str("to", call.CallTo).Msg("Call is not relevant")
-		return nil
+		return false
+	}
+
+	return true
+}
+
+// processLegs processes the relevant legs of a single ongoing call from 3CX. The call is reported for one of its
+// legs, see primaryLeg. The caller has to hold z.mu.
+func (z *ZammadBridge) processLegs(legs []CallInformation) {
+	l, ok := z.ongoingCalls[legs[0].ID]
+	var currentAgent string
+	if ok {
+		currentAgent = l.Call.AgentNumber
 	}
 
+	primary := z.primaryLeg(legs, currentAgent)
+	call := &primary
+
 	log.Trace().Str("call_id", call.CallUID).Str("direction", call.Direction).Str("from", call.CallFrom).Str("to", call.CallTo).Msg("Processing call")
 
-	if z.isNewCall(call) {
-		// Save it for the first time
-		call.CallUID = uuid.New().String()
+	previousAgent := call.AgentNumber
+	if !ok {
+		// Save it for the first time. The time of the poll is used if known, which a replay reproduces exactly
+		call.FirstSeenAt = call.PolledAt
+		if call.FirstSeenAt.IsZero() {
+			call.FirstSeenAt = z.clock()
+		}
+		call.CallUID = z.callUID(call)
+		l = newCallLifecycle(*call)
+		z.ongoingCalls[call.ID] = l
 
-		// Notify all active Zammad clients that someone is calling
+		// Notify all sinks that someone is calling
 		log.Info().Str("call_id", call.CallUID).Str("direction", call.Direction).Str("from", call.CallFrom).Str("to", call.CallTo).Msg("New call")
-		z.LogIfErr(z.ZammadNewCall(call), "new-call")
+		z.sendNewCall(l)
 	} else {
 		// Update call information
-		previous := z.ongoingCalls[call.ID]
-		call.CallUID = previous.CallUID
-		call.ZammadInitialized = previous.ZammadInitialized
-		call.ZammadAnswered = previous.ZammadAnswered
-
-		// If the call is now "Talking", it means we are currently talking to someone. It is with someone of our loaded
-		// extensions due to the early-return that otherwise would have happened.
-		// We should then, for once, let Zammad know we answered this call. Since the "Talking" status can be present
-		// every tick, we need to check if we already notified Zammad and only notify Zammad as-needed.
-		if call.Status == "Talking" && !previous.ZammadAnswered && !z.isCallToQueue(*call) {
-			log.Info().Str("call_id", call.CallUID).Str("direction", call.Direction).Str("from", call.CallFrom).Str("to", call.CallTo).Msg("Call answered")
-			z.LogIfErr(z.ZammadAnswer(call), "answer")
+		previousAgent = l.Call.AgentNumber
+		call.CallUID = l.Call.CallUID
+		call.FirstSeenAt = l.Call.FirstSeenAt
+		call.AnsweredAt = l.Call.AnsweredAt
+		l.Call = *call
+	}
+
+	z.trackLegs(l, legs)
+	z.observe(l)
+	z.advanceCall(l, previousAgent)
+}
+
+// clock returns the current time, which is the time of the recorded traffic when replaying.
+func (z *ZammadBridge) clock() time.Time {
+	if z.now != nil {
+		return z.now()
+	}
+
+	return time.Now()
+}
+
+// callUID derives the identifier of the call within Zammad from the 3CX host, the 3CX call ID and the start
+// time of the call, because 3CX starts counting call IDs again after a restart. It is deterministic, so a restarted
+// bridge uses the same identifier for a call that is still ongoing. 3CX v20 does not report when a call started, in
+// which case the time the bridge first saw the call is used, which the state file keeps across restarts.
+func (z *ZammadBridge) callUID(call *CallInformation) string {
+	start := call.EstablishedAt
+	if start.IsZero() {
+		start = call.FirstSeenAt
+	}
+
+	name := z.Config.Phone3CX.Host + "/" + call.ID.String()
+	if !start.IsZero() {
+		name += "@" + start.UTC().Format(time.RFC3339Nano)
+	}
+
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(name)).String()
+}
+
+// advanceCall moves the call to the state that 3CX reports, and notifies the sinks about the change.
+// The "Talking" status is present every tick, so only actual changes of the state result in events.
+func (z *ZammadBridge) advanceCall(l *callLifecycle, previousAgent string) {
+	call := &l.Call
+
+	if previousAgent != call.AgentNumber && (l.State == CallStateAnswered || l.State == CallStateHeld) {
+		if l.transition(CallStateTransferred, z.clock()) {
+			log.Info().Str("call_id", call.CallUID).Str("direction", call.Direction).Str("from", previousAgent).Str("to", call.AgentNumber).Msg("Call transferred")
+			z.notifyTransfer(l)
 		}
 	}
 
-	z.ongoingCalls[call.ID] = *call
-	return nil
+	target := z.observedState(call)
+	if target == l.State || !l.transition(target, z.clock()) {
+		return
+	}
+
+	// If the call is now "Talking", it means we are currently talking to someone. It is with someone of our loaded
+	// extensions due to the early-return that otherwise would have happened.
+	if target == CallStateAnswered {
+		if call.AnsweredAt.IsZero() {
+			call.AnsweredAt = z.clock()
+		}
+
+		log.Info().Str("call_id", call.CallUID).Str("direction", call.Direction).Str("from", call.CallFrom).Str("to", call.CallTo).Msg("Call answered")
+		z.sendAnswer(l)
+	}
+}
+
+// callGone counts a poll in which 3CX did not report the call, and checks whether the call has been missing long
+// enough to be considered ended, see Bridge.EndAfterPolls and Bridge.EndAfter.
+func (z *ZammadBridge) callGone(l *callLifecycle) bool {
+	if l.MissedPolls == 0 {
+		l.MissingSince = z.clock()
+	}
+	l.MissedPolls++
+	l.changed = true
+
+	endAfterPolls := z.Config.Bridge.EndAfterPolls
+	if endAfterPolls <= 0 {
+		endAfterPolls = 2
+	}
+
+	endAfter := time.Duration(float64(time.Second) * z.Config.Bridge.EndAfter)
+	return l.MissedPolls >= endAfterPolls && z.clock().Sub(l.MissingSince) >= endAfter
+}
+
+// endCall finishes the lifecycle of a call that is no longer reported by 3CX. The call ended when it was missing
+// for the first time.
+func (z *ZammadBridge) endCall(l *callLifecycle) {
+	call := &l.Call
+	call.EndedAt = z.clock()
+	if !l.MissingSince.IsZero() {
+		call.EndedAt = l.MissingSince
+	}
+
+	if !l.transition(CallStateEnded, call.EndedAt) {
+		return
+	}
+
+	outcome := l.outcome()
+	if outcome == CallOutcomeQueueAbandoned {
+		log.Info().Str("call_id", call.CallUID).Str("direction", call.Direction).Str("from", call.CallFrom).Str("to", call.CallTo).Msg("Queue call was not answered")
+
+		// The hangup is always sent, as the sinks were told about the call. Only the agent it is logged for differs
+		if z.Config.Zammad.LogMissedQueueCalls {
+			call.AgentNumber = strconv.Itoa(z.Config.Phone3CX.QueueExtension)
+		}
+	} else {
+		log.Info().Str("call_id", call.CallUID).Str("direction", call.Direction).Str("from", call.CallFrom).Str("to", call.CallTo).Str("outcome", string(outcome)).Msg("Call ended")
+	}
+
+	z.sendHangup(l, outcome)
 }
 
 // isInboundCall checks whether the given call is an inbound call.
@@ -197,6 +434,11 @@ func (z *ZammadBridge) isInboundCall(call *CallInformation) bool {
 		return false
 	}
 
+	// Calls that went to the voicemail remain relevant, so they can be reported as missed
+	if z.isVoicemail(call) {
+		return true
+	}
+
 	if len(call.CalleeNumber) != z.Config.Phone3CX.ExtensionDigits {
 		return false
 	}
@@ -225,12 +467,6 @@ func (z *ZammadBridge) isOutboundCall(call *CallInformation) bool {
 	return true
 }
 
-// isNewCall checks whether the given call is already ongoing and previously detected by the bridge.
-func (z *ZammadBridge) isNewCall(call *CallInformation) bool {
-	_, ok := z.ongoingCalls[call.ID]
-	return !ok
-}
-
 // ParsePhoneNumber parses the phone number into a format acceptable to Zammad
 func (z *ZammadBridge) ParsePhoneNumber(number string) string {
 	// Number is between two brackets, e.g. (0123)
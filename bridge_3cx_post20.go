@@ -13,7 +13,9 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/coder/websocket"
 	"github.com/rs/zerolog/log"
@@ -59,24 +61,44 @@ type CallParticipant struct {
 	// PartyDID is the DID of the caller. Can be empty.
 	PartyDID string `json:"party_did"`
 
+	// PartyDNType is the type of the other party. E.g. "Wexternalline"
+	PartyDNType string `json:"party_dn_type"`
+
 	// CallID is the unique ID of the call.
 	CallID int `json:"callid"`
+
+	// LegID identifies the participant within the call, e.g. the queue and each agent of a conference.
+	LegID int `json:"legid"`
 }
 
 type CallControlResponse []CallControlResponseEntry
 
 type CallControlResponseEntry struct {
-	DN           string            `json:"dn"`
+	DN string `json:"dn"`
+
+	// Type is the type of the DN, e.g. "Wextension", "Wqueue" or "Wivr" for a digital receptionist.
+	Type         string            `json:"type"`
 	Participants []CallParticipant `json:"participants"`
 }
 
 type Client3CXPost20 struct {
 	Config *Config
 
-	client http.Client
+	client  http.Client
+	journal *Journal
 
 	// accessToken is a Bearer-token retrieved after a valid Authentication call. It will expire automatically.
+	// It is guarded by tokenMu, because recordings are fetched in the background.
 	accessToken string
+	tokenMu     sync.RWMutex
+}
+
+// authorization returns the value for the Authorization header of requests to 3CX.
+func (z *Client3CXPost20) authorization() string {
+	z.tokenMu.RLock()
+	defer z.tokenMu.RUnlock()
+
+	return "Bearer " + z.accessToken
 }
 
 func (z *Client3CXPost20) FetchCalls() ([]CallInformation, error) {
@@ -85,13 +107,26 @@ func (z *Client3CXPost20) FetchCalls() ([]CallInformation, error) {
 	// If we receive a call, we get some entity like this:
 	// {"level":"debug","entity":"{\"id\":8106,\"status\":\"Ringing\",\"dn\":\"150\",\"party_caller_name\":\"+49123456789\",\"party_dn\":\"10007\",\"party_caller_id\":\"0123456789\",\"party_did\":\"\",\"device_id\":\"sip:150@127.0.0.1:5483;rinstance=c2a75fd2f1caea71\",\"party_dn_type\":\"Wexternalline\",\"direct_control\":false,\"originated_by_dn\":\"ROUTER\",\"originated_by_type\":\"Wroutepoint\",\"referred_by_dn\":\"\",\"referred_by_type\":\"None\",\"on_behalf_of_dn\":\"\",\"on_behalf_of_type\":\"None\",\"callid\":1264,\"legid\":4}","sequence":15,"event_type":0,"time":"2024-12-30T15:11:48+01:00","message":"Received from 3CX WS"}
 
+	data, err := z.fetchCallControl()
+	polledAt := z.journal.Record(JournalKindCallControl, data, err)
+	if err != nil {
+		return nil, err
+	}
+
+	calls, err := z.parseCallControl(data)
+	setPolledAt(calls, polledAt)
+	return calls, err
+}
+
+// fetchCallControl requests the raw state of all DNs and their participants from 3CX.
+func (z *Client3CXPost20) fetchCallControl() ([]byte, error) {
 	values := url.Values{}
 	req, err := http.NewRequest(http.MethodGet, z.Config.Phone3CX.Host+"/callcontrol?"+values.Encode(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("unable to prepare HTTP request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+z.accessToken)
+	req.Header.Set("Authorization", z.authorization())
 
 	// Request to /api/GroupList and then look for the name
 	resp, err := z.client.Do(req)
@@ -115,8 +150,13 @@ func (z *Client3CXPost20) FetchCalls() ([]CallInformation, error) {
 		return nil, fmt.Errorf("unable to read response body: %w", err)
 	}
 
+	return respBody, nil
+}
+
+// parseCallControl parses the response of /callcontrol into the legs of the ongoing calls.
+func (z *Client3CXPost20) parseCallControl(data []byte) ([]CallInformation, error) {
 	var callControlResponse CallControlResponse
-	err = json.Unmarshal(respBody, &callControlResponse)
+	err := json.Unmarshal(data, &callControlResponse)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse response JSON: %w", err)
 	}
@@ -128,24 +168,27 @@ func (z *Client3CXPost20) FetchCalls() ([]CallInformation, error) {
 	return z.aggregateCallResponse(callControlResponse), nil
 }
 
-func (z *Client3CXPost20) convertParticipant(participant CallParticipant, dn string) CallInformation {
+func (z *Client3CXPost20) convertParticipant(participant CallParticipant, entry CallControlResponseEntry) CallInformation {
 	if participant.Status == "Connected" {
 		participant.Status = "Talking" // This is the pre v20 status
 	}
 
 	return CallInformation{
-		ID: json.Number(strconv.Itoa(participant.CallID)),
+		ID:    json.Number(strconv.Itoa(participant.CallID)),
+		LegID: json.Number(strconv.Itoa(participant.LegID)),
 		// CallUID: strconv.Itoa(participant.CallID),
 
 		Status:       participant.Status,
 		CallerNumber: participant.PartyDN,
 		CallerName:   participant.PartyCallerName + " (" + participant.PartyCallerID + ")", // This would now be of the format "(+491234567890)"
+		CallerType:   participant.PartyDNType,
 		CalleeNumber: participant.DN,
 		CalleeName:   "",
-		AgentNumber:  dn,
+		CalleeType:   entry.Type,
+		AgentNumber:  entry.DN,
 
+		// The call control API does not tell when the call started, so EstablishedAt is left empty
 		LastChangeStatus: time.Now(),
-		EstablishedAt:    time.Now(), // Not quite correct ...
 	}
 }
 
@@ -153,7 +196,7 @@ func (z *Client3CXPost20) aggregateCallResponse(response CallControlResponse) []
 	var calls []CallInformation
 	for _, entry := range response {
 		for _, participant := range entry.Participants {
-			calls = append(calls, z.convertParticipant(participant, entry.DN))
+			calls = append(calls, z.convertParticipant(participant, entry))
 		}
 	}
 
@@ -174,9 +217,14 @@ func (z *Client3CXPost20) listenWS() {
 	// Start a WS connection
 	ctx := context.Background()
 
+	// The websocket library requires cancellation through the context instead of a client timeout
+	wsClient := z.client
+	wsClient.Timeout = 0
+
 	c, _, err := websocket.Dial(ctx, z.Config.Phone3CX.Host+"/callcontrol/ws", &websocket.DialOptions{
+		HTTPClient: &wsClient,
 		HTTPHeader: http.Header{
-			"Authorization": []string{"Bearer " + z.accessToken},
+			"Authorization": []string{z.authorization()},
 		},
 	})
 	if err != nil {
@@ -234,6 +282,8 @@ func (z *Client3CXPost20) listenWS() {
 			return
 		}
 
+		z.journal.Record(JournalKindWebsocket, data, nil)
+
 		err = z.processWSMessage(data)
 		if err != nil {
 			log.Error().Err(err).Msg("Error processing WS message")
@@ -279,14 +329,13 @@ func (z *Client3CXPost20) processWSMessage(msg []byte) error {
 	return nil
 }
 
-//nolint:unused
 func httpGET3CX[T any](z *Client3CXPost20, url string) (*T, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("unable to prepare HTTP request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+z.accessToken)
+	req.Header.Set("Authorization", z.authorization())
 
 	resp, err := z.client.Do(req)
 	if err != nil {
@@ -435,7 +484,9 @@ func (z *Client3CXPost20) Authenticate() error {
 		return fmt.Errorf("unable to unmarshal access token: %w", err)
 	}
 
+	z.tokenMu.Lock()
 	z.accessToken = tokenResponse.AccessToken
+	z.tokenMu.Unlock()
 
 	log.Debug().Msg("Successfully authenticated to 3CX")
 
@@ -477,3 +528,174 @@ func (z *Client3CXPost20) IsExtension(_ string) bool {
 	// Therefore, we can assume that if we are monitoring an extension, it is valid.
 	return true
 }
+
+// FindRecording looks for the recording of the call through the XAPI. Recordings are matched by the numbers of the
+// agent and the external party, and the one that started closest to the call is taken.
+func (z *Client3CXPost20) FindRecording(call CallInformation) (*Recording, error) {
+	start := call.EstablishedAt
+	if start.IsZero() {
+		start = call.FirstSeenAt
+	}
+
+	filter := "StartTime ge " + start.Add(-time.Minute).UTC().Format(time.RFC3339)
+	if !call.EndedAt.IsZero() {
+		filter += " and StartTime le " + call.EndedAt.Add(time.Minute).UTC().Format(time.RFC3339)
+	}
+
+	values := url.Values{
+		"$filter":  {filter},
+		"$orderby": {"StartTime asc"},
+		"$top":     {"50"},
+	}
+
+	response, err := httpGET3CX[struct {
+		Value []Recording `json:"value"`
+	}](z, z.Config.Phone3CX.Host+"/xapi/v1/Recordings?"+values.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list recordings: %w", err)
+	}
+
+	// Recordings are looked up in the background, while the configuration may be reloaded
+	configMu.RLock()
+	countryPrefix := z.Config.Phone3CX.CountryPrefix
+	configMu.RUnlock()
+
+	var closest *Recording
+	for i, recording := range response.Value {
+		if !recordingMatches(recording, call, countryPrefix) {
+			continue
+		}
+
+		if closest == nil || absDuration(recording.StartTime.Sub(start)) < absDuration(closest.StartTime.Sub(start)) {
+			closest = &response.Value[i]
+		}
+	}
+
+	return closest, nil
+}
+
+// recordingMatches checks whether the recording is between the agent and the external party of the call. Without
+// both numbers, no recording matches.
+func recordingMatches(recording Recording, call CallInformation, countryPrefix string) bool {
+	agent := comparableNumber(call.AgentNumber, "")
+	external := comparableNumber(call.ExternalNumber, countryPrefix)
+	if agent == "" || external == "" {
+		return false
+	}
+
+	from := comparableNumber(recording.From, countryPrefix)
+	to := comparableNumber(recording.To, countryPrefix)
+
+	return (from == agent && to == external) || (from == external && to == agent)
+}
+
+// comparableNumber reduces a phone number to its significant digits, such that numbers in the formats of 3CX and
+// the bridge can be compared, e.g. "+49 30 1234", "0049301234" and "030 1234 (Jane Doe)" all become "301234".
+func comparableNumber(number string, countryPrefix string) string {
+	if open, end := strings.Index(number, "("), strings.LastIndex(number, ")"); open >= 0 && end > open && strings.ContainsAny(number[open:end], "0123456789") {
+		number = number[open+1 : end]
+	}
+
+	var digits strings.Builder
+	for _, r := range number {
+		if (r >= '0' && r <= '9') || (r == '+' && digits.Len() == 0) {
+			digits.WriteRune(r)
+		} else if unicode.IsLetter(r) && digits.Len() > 0 {
+			break
+		}
+	}
+
+	n := digits.String()
+	if countryPrefix != "" {
+		for _, prefix := range []string{"+" + countryPrefix, "00" + countryPrefix, countryPrefix} {
+			if strings.HasPrefix(n, prefix) {
+				n = n[len(prefix):]
+				break
+			}
+		}
+	}
+
+	return strings.TrimLeft(n, "+0")
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
+
+// DownloadRecording downloads the audio file of the recording.
+func (z *Client3CXPost20) DownloadRecording(recording *Recording, maxSize int64) ([]byte, error) {
+	body, err := z.OpenRecording(recording)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response body: %w", err)
+	}
+
+	if int64(len(data)) > maxSize {
+		return nil, errRecordingTooLarge
+	}
+
+	return data, nil
+}
+
+// OpenRecording starts downloading the audio file of the recording. The caller has to close it.
+func (z *Client3CXPost20) OpenRecording(recording *Recording) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/xapi/v1/Recordings/Pbx.DownloadRecording(recId=%d)", z.Config.Phone3CX.Host, recording.ID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare HTTP request: %w", err)
+	}
+
+	req.Header.Set("Authorization", z.authorization())
+
+	resp, err := z.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to perform HTTP request: %w", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response downloading recording from 3CX (HTTP %d): %s", resp.StatusCode, string(data))
+	}
+
+	return resp.Body, nil
+}
+
+// MakeCall lets the extension call the destination through the call control API.
+func (z *Client3CXPost20) MakeCall(extension string, destination string) error {
+	requestBody, err := json.Marshal(map[string]string{
+		"destination": destination,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to serialize JSON request body: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, z.Config.Phone3CX.Host+"/callcontrol/"+url.PathEscape(extension)+"/makecall", bytes.NewReader(requestBody))
+	if err != nil {
+		return fmt.Errorf("unable to prepare HTTP request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", z.authorization())
+
+	resp, err := z.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to perform HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response making a call through 3CX (HTTP %d): %s", resp.StatusCode, string(data))
+	}
+
+	return nil
+}
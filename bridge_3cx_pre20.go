@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -16,15 +17,28 @@ import (
 type Client3CXPre20 struct {
 	Config *Config
 
-	client          http.Client
-	phoneExtensions map[string]struct{}
+	client  http.Client
+	journal *Journal
+
+	// phoneExtensions is replaced when authenticating again, while calls may be processed concurrently.
+	phoneExtensions   map[string]struct{}
+	phoneExtensionsMu sync.RWMutex
 }
 
 func (z *Client3CXPre20) FetchCalls() ([]CallInformation, error) {
-	type CallInformationResponse struct {
-		List []CallInformation `json:"list"`
+	data, err := z.fetchActiveCalls()
+	polledAt := z.journal.Record(JournalKindActiveCalls, data, err)
+	if err != nil {
+		return nil, err
 	}
 
+	calls, err := parseActiveCalls(data)
+	setPolledAt(calls, polledAt)
+	return calls, err
+}
+
+// fetchActiveCalls requests the raw list of ongoing calls from 3CX.
+func (z *Client3CXPre20) fetchActiveCalls() ([]byte, error) {
 	resp, err := z.client.Get(z.Config.Phone3CX.Host + "/api/activeCalls")
 	if err != nil {
 		return nil, fmt.Errorf("unable to request from 3CX: %w", err)
@@ -41,8 +55,17 @@ func (z *Client3CXPre20) FetchCalls() ([]CallInformation, error) {
 		return nil, fmt.Errorf("unable to read response body: %w", err)
 	}
 
+	return data, nil
+}
+
+// parseActiveCalls parses the list of ongoing calls as returned by /api/activeCalls.
+func parseActiveCalls(data []byte) ([]CallInformation, error) {
+	type CallInformationResponse struct {
+		List []CallInformation `json:"list"`
+	}
+
 	var response CallInformationResponse
-	err = json.Unmarshal(data, &response)
+	err := json.Unmarshal(data, &response)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse JSON response: %w", err)
 	}
@@ -80,16 +103,16 @@ func (z *Client3CXPre20) fetchGroupMembers() error {
 
 	var startIndex = 0
 	var allExtensions []string
-	z.phoneExtensions = map[string]struct{}{}
+	phoneExtensions := map[string]struct{}{}
 
-	for len(z.phoneExtensions) < count && startIndex <= count {
+	for len(phoneExtensions) < count && startIndex <= count {
 		extensions, err := z.fetchGroupMembersPage(objectId, startIndex)
 		if err != nil {
 			return fmt.Errorf("unable to fetch group members from index %d from group %s: %w", startIndex, groupId, err)
 		}
 
 		for _, e := range extensions {
-			z.phoneExtensions[e] = struct{}{}
+			phoneExtensions[e] = struct{}{}
 			allExtensions = append(allExtensions, e)
 		}
 
@@ -100,6 +123,10 @@ func (z *Client3CXPre20) fetchGroupMembers() error {
 		startIndex += len(extensions)
 	}
 
+	z.phoneExtensionsMu.Lock()
+	z.phoneExtensions = phoneExtensions
+	z.phoneExtensionsMu.Unlock()
+
 	log.Info().Interface("extensions", allExtensions).Msg("Loaded extensions")
 
 	return nil
@@ -288,6 +315,29 @@ func (z *Client3CXPre20) AuthenticateRetry(maxOffline time.Duration) error {
 }
 
 func (z *Client3CXPre20) IsExtension(number string) bool {
+	z.phoneExtensionsMu.RLock()
+	defer z.phoneExtensionsMu.RUnlock()
+
 	_, ok := z.phoneExtensions[number]
 	return ok
 }
+
+// FindRecording is not supported before v20.
+func (z *Client3CXPre20) FindRecording(_ CallInformation) (*Recording, error) {
+	return nil, ErrNotSupported
+}
+
+// DownloadRecording is not supported before v20.
+func (z *Client3CXPre20) DownloadRecording(_ *Recording, _ int64) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+// OpenRecording is not supported before v20.
+func (z *Client3CXPre20) OpenRecording(_ *Recording) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// MakeCall is not supported before v20.
+func (z *Client3CXPre20) MakeCall(_ string, _ string) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,284 @@
+package zammadbridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubAPI3CX reports a new call every few polls: it rings, is answered and then disappears, such that the bridge
+// sends every kind of event.
+type stubAPI3CX struct {
+	API3CX
+
+	mu    sync.Mutex
+	polls int
+	quiet bool
+}
+
+func (s *stubAPI3CX) FetchCalls() ([]CallInformation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.quiet {
+		return nil, nil
+	}
+
+	round, poll := s.polls/6, s.polls%6
+	s.polls++
+
+	switch {
+	case poll == 0:
+		return []CallInformation{stubCall(strconv.Itoa(round), "Ringing")}, nil
+	case poll < 3:
+		return []CallInformation{stubCall(strconv.Itoa(round), "Talking")}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (s *stubAPI3CX) IsExtension(number string) bool {
+	return len(number) == 3
+}
+
+// stubCall is an inbound call from an external number to extension 150.
+func stubCall(id string, status string) CallInformation {
+	return CallInformation{ID: json.Number(id), CallerNumber: "12345", CalleeNumber: "150", Status: status}
+}
+
+// eventLog is a sink that records the events it receives per call.
+type eventLog struct {
+	mu     sync.Mutex
+	events map[string][]string
+}
+
+func (e *eventLog) record(call *CallInformation, event string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.events[call.CallUID] = append(e.events[call.CallUID], event)
+	return nil
+}
+
+func (e *eventLog) Name() string {
+	return "events"
+}
+
+func (e *eventLog) NewCall(call *CallInformation) error {
+	return e.record(call, "newCall")
+}
+
+func (e *eventLog) Answer(call *CallInformation) error {
+	return e.record(call, "answer")
+}
+
+func (e *eventLog) Transfer(call *CallInformation) error {
+	return e.record(call, "transfer")
+}
+
+func (e *eventLog) Hangup(call *CallInformation, _ CallOutcome) error {
+	return e.record(call, "hangup")
+}
+
+// TestConcurrentProcessing polls 3CX, processes single calls and serves the ongoing calls at the same time. Run it
+// with -race to find unsynchronized access to the calls.
+func TestConcurrentProcessing(t *testing.T) {
+	config := &Config{}
+	config.Phone3CX.ExtensionDigits = 3
+	config.Phone3CX.TrunkDigits = 5
+	config.Bridge.StateFile = t.TempDir() + "/state.json"
+	config.Bridge.ApiSecret = "secret"
+
+	history, err := OpenHistory(t.TempDir()+"/history.db", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+
+	client := &stubAPI3CX{}
+	events := &eventLog{events: map[string][]string{}}
+	z := &ZammadBridge{
+		Config:       config,
+		Client3CX:    client,
+		Sinks:        []CallEventSink{events},
+		ongoingCalls: map[json.Number]*callLifecycle{},
+		state:        &stateFile{path: config.Bridge.StateFile},
+		history:      history,
+	}
+
+	handler := z.authenticated(z.handleCalls)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				err := z.RequestAndProcess()
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				call := stubCall("900", "Ringing")
+				err := z.ProcessCall(&call)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/calls", nil)
+				req.Header.Set("Authorization", "Bearer secret")
+				rec := httptest.NewRecorder()
+				handler(rec, req)
+
+				var calls []CallSnapshot
+				if rec.Code != http.StatusOK {
+					t.Errorf("GET /calls: HTTP %d", rec.Code)
+				} else if err := json.Unmarshal(rec.Body.Bytes(), &calls); err != nil {
+					t.Errorf("GET /calls: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// End the remaining calls
+	client.mu.Lock()
+	client.quiet = true
+	client.mu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		err := z.RequestAndProcess()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls := z.Calls(); len(calls) != 0 {
+		t.Errorf("expected no ongoing calls, got %d", len(calls))
+	}
+
+	if len(events.events) == 0 {
+		t.Fatal("expected events")
+	}
+
+	for uid, sent := range events.events {
+		if sent[0] != "newCall" || sent[len(sent)-1] != "hangup" {
+			t.Errorf("call %s: expected newCall first and hangup last, got %v", uid, sent)
+		}
+
+		counts := map[string]int{}
+		for _, event := range sent {
+			counts[event]++
+		}
+		if counts["newCall"] != 1 || counts["hangup"] != 1 {
+			t.Errorf("call %s: expected one newCall and one hangup, got %v", uid, sent)
+		}
+	}
+}
+
+// blockingSink holds every event until it is released, like a sink that waits for a slow server.
+type blockingSink struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingSink) wait() error {
+	select {
+	case b.entered <- struct{}{}:
+	default:
+	}
+
+	<-b.release
+	return nil
+}
+
+func (b *blockingSink) Name() string {
+	return "blocking"
+}
+
+func (b *blockingSink) NewCall(_ *CallInformation) error {
+	return b.wait()
+}
+
+func (b *blockingSink) Answer(_ *CallInformation) error {
+	return b.wait()
+}
+
+func (b *blockingSink) Transfer(_ *CallInformation) error {
+	return b.wait()
+}
+
+func (b *blockingSink) Hangup(_ *CallInformation, _ CallOutcome) error {
+	return b.wait()
+}
+
+// TestCallsWhileDelivering checks that the ongoing calls are served while a sink is still busy with an event.
+func TestCallsWhileDelivering(t *testing.T) {
+	config := &Config{}
+	config.Phone3CX.ExtensionDigits = 3
+	config.Phone3CX.TrunkDigits = 5
+	config.Bridge.ApiSecret = "secret"
+
+	sink := &blockingSink{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	z := &ZammadBridge{
+		Config:       config,
+		Client3CX:    &stubAPI3CX{},
+		Sinks:        []CallEventSink{sink},
+		ongoingCalls: map[json.Number]*callLifecycle{},
+	}
+
+	processed := make(chan error, 1)
+	go func() {
+		processed <- z.RequestAndProcess()
+	}()
+
+	select {
+	case <-sink.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sink did not receive the newCall event")
+	}
+
+	answered := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/calls", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		z.authenticated(z.handleCalls)(rec, req)
+		answered <- rec
+	}()
+
+	select {
+	case rec := <-answered:
+		var calls []CallSnapshot
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET /calls: HTTP %d", rec.Code)
+		} else if err := json.Unmarshal(rec.Body.Bytes(), &calls); err != nil {
+			t.Errorf("GET /calls: %v", err)
+		} else if len(calls) != 1 {
+			t.Errorf("expected 1 ongoing call, got %d", len(calls))
+		}
+	case <-time.After(time.Second):
+		t.Error("GET /calls waited for the sink")
+	}
+
+	close(sink.release)
+	err := <-processed
+	if err != nil {
+		t.Fatal(err)
+	}
+}
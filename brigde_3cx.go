@@ -2,8 +2,9 @@ package zammadbridge
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"io"
 	"net/http/cookiejar"
 	"strings"
 	"time"
@@ -16,20 +17,30 @@ type CallInformation struct {
 	Caller string      `json:"Caller"`
 	Callee string      `json:"Callee"`
 
+	// LegID identifies the participant within the call, see CallLeg. Only in v20 and above
+	LegID json.Number
+
 	// Status has possible values: "Talking", "Transferring", "Routing"
-	Status            string `json:"Status"`
-	ZammadInitialized bool
-	ZammadAnswered    bool
+	Status string `json:"Status"`
 
 	// Timestamps
 	LastChangeStatus time.Time `json:"LastChangeStatus"`
 	EstablishedAt    time.Time `json:"EstablishedAt"`
 
+	// Timestamps kept by the bridge itself. PolledAt is when 3CX reported the call, which is the time of the journal
+	// entry, such that a replay of the journal sees the calls at the same time.
+	PolledAt    time.Time
+	FirstSeenAt time.Time
+	AnsweredAt  time.Time
+	EndedAt     time.Time
+
 	// Various processed fields
 	CallerName     string
 	CallerNumber   string
 	CalleeName     string
 	CalleeNumber   string
+	CallerType     string // Only in v20 and above
+	CalleeType     string // Only in v20 and above
 	CallUID        string
 	Direction      string
 	AgentName      string
@@ -39,6 +50,32 @@ type CallInformation struct {
 	ExternalNumber string
 }
 
+// RingDuration returns how long the call rang before it was answered or ended.
+func (c *CallInformation) RingDuration() time.Duration {
+	if c.FirstSeenAt.IsZero() {
+		return 0
+	}
+
+	if !c.AnsweredAt.IsZero() {
+		return c.AnsweredAt.Sub(c.FirstSeenAt)
+	}
+
+	if !c.EndedAt.IsZero() {
+		return c.EndedAt.Sub(c.FirstSeenAt)
+	}
+
+	return 0
+}
+
+// TalkDuration returns how long the call was answered, which is zero for calls that were never answered.
+func (c *CallInformation) TalkDuration() time.Duration {
+	if c.AnsweredAt.IsZero() || c.EndedAt.IsZero() {
+		return 0
+	}
+
+	return c.EndedAt.Sub(c.AnsweredAt)
+}
+
 type GroupListResponseEntry struct {
 	Item GroupListEntryObject `json:"Item"`
 }
@@ -65,6 +102,32 @@ type API3CX interface {
 
 	// IsExtension checks if a given phone number is a valid extension that is being monitored.
 	IsExtension(number string) bool
+
+	// FindRecording looks for the recording of the given call. It returns nil if there is no recording (yet),
+	// and ErrNotSupported if the 3CX version does not offer recordings through its API.
+	FindRecording(call CallInformation) (*Recording, error)
+
+	// DownloadRecording downloads the audio file of the recording, failing if it exceeds maxSize bytes.
+	DownloadRecording(recording *Recording, maxSize int64) ([]byte, error)
+
+	// OpenRecording starts downloading the audio file of the recording, e.g. to pass it on. The caller has to close it.
+	OpenRecording(recording *Recording) (io.ReadCloser, error)
+
+	// MakeCall lets the phone of the extension call the destination. It returns ErrNotSupported if the 3CX version
+	// does not offer call control.
+	MakeCall(extension string, destination string) error
+}
+
+// ErrNotSupported is returned by API3CX for features that the 3CX version does not support.
+var ErrNotSupported = errors.New("not supported by this 3CX version")
+
+// Recording describes a call recording stored on 3CX.
+type Recording struct {
+	ID        int       `json:"Id"`
+	StartTime time.Time `json:"StartTime"`
+	EndTime   time.Time `json:"EndTime"`
+	From      string    `json:"FromCallerNumber"`
+	To        string    `json:"ToCallerNumber"`
 }
 
 // Create3CXClient creates a 3CX client based on the provided configuration.
@@ -73,20 +136,25 @@ type API3CX interface {
 // it falls back to creating a pre-v20 client.
 // The function returns an API3CX interface and an error if the client creation fails.
 //
-// The client is created with a cookiejar and authenticated using the AuthenticateRetry method,
+// The client is created with a cookiejar and the configured transport settings, and authenticated using the AuthenticateRetry method,
 // which waits for the client to come online for a maximum duration of two minutes.
-func Create3CXClient(c *Config) (API3CX, error) {
+// The raw responses of 3CX are recorded in the journal, which may be nil.
+func Create3CXClient(c *Config, journal *Journal) (API3CX, error) {
 	jar, err := cookiejar.New(nil)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create cookiejar: %w", err)
 	}
 
+	client, err := c.Phone3CX.Transport.NewHTTPClient(jar)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create HTTP client: %w", err)
+	}
+
 	// Try creating a v20 client, and if it fails with HTTP 404, we fallback to pre-v20
 	v20 := &Client3CXPost20{
-		Config: c,
-		client: http.Client{
-			Jar: jar,
-		},
+		Config:  c,
+		client:  client,
+		journal: journal,
 	}
 
 	err = v20.AuthenticateRetry(120 * time.Second)
@@ -103,10 +171,9 @@ func Create3CXClient(c *Config) (API3CX, error) {
 		Msg("Falling back to 3CX (legacy) API client due to HTTP 404 error")
 
 	preV20 := &Client3CXPre20{
-		Config: c,
-		client: http.Client{
-			Jar: jar,
-		},
+		Config:  c,
+		client:  client,
+		journal: journal,
 	}
 
 	err = preV20.AuthenticateRetry(120 * time.Second)
@@ -116,3 +183,10 @@ func Create3CXClient(c *Config) (API3CX, error) {
 
 	return preV20, nil
 }
+
+// setPolledAt records when the calls were reported by 3CX.
+func setPolledAt(calls []CallInformation, at time.Time) {
+	for i := range calls {
+		calls[i].PolledAt = at
+	}
+}
@@ -0,0 +1,287 @@
+package zammadbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CallState is the state of a call within its lifecycle, as seen by the bridge.
+type CallState int
+
+const (
+	CallStateNew CallState = iota
+	CallStateRinging
+	CallStateAnswered
+	CallStateHeld
+	CallStateTransferred
+	CallStateEnded
+)
+
+func (s CallState) String() string {
+	switch s {
+	case CallStateNew:
+		return "new"
+	case CallStateRinging:
+		return "ringing"
+	case CallStateAnswered:
+		return "answered"
+	case CallStateHeld:
+		return "held"
+	case CallStateTransferred:
+		return "transferred"
+	case CallStateEnded:
+		return "ended"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// callStateTransitions lists the states that can follow each state, as advanceCall moves the calls. Every state may
+// end. Only answered and held calls are transferred, when their agent changes, and they do not ring again until then.
+var callStateTransitions = map[CallState][]CallState{
+	CallStateNew:         {CallStateRinging, CallStateAnswered, CallStateHeld, CallStateEnded},
+	CallStateRinging:     {CallStateAnswered, CallStateHeld, CallStateEnded},
+	CallStateAnswered:    {CallStateHeld, CallStateTransferred, CallStateEnded},
+	CallStateHeld:        {CallStateAnswered, CallStateTransferred, CallStateEnded},
+	CallStateTransferred: {CallStateRinging, CallStateAnswered, CallStateHeld, CallStateEnded},
+	CallStateEnded:       {},
+}
+
+// callLifecycle follows a single call from start to end. It guarantees that the sinks receive exactly one newCall,
+// at most one answer per leg, and exactly one hangup.
+type callLifecycle struct {
+	Call    CallInformation
+	State   CallState
+	History []CallState
+
+	NewCallSent  bool
+	AnsweredLegs map[string]struct{}
+	HangupSent   bool
+
+	// Observations used to derive the outcome of the call, see callLifecycle.outcome. Rejected lists the agents
+	// whose leg stopped ringing while the call went on.
+	Agents    []string
+	Rejected  []string
+	InQueue   bool
+	Voicemail bool
+
+	// Legs are the legs of the call that 3CX currently reports, by leg ID. Conference lists the agents that
+	// talked on the call besides the one it is reported for.
+	Legs       map[string]CallLeg
+	Conference []string
+
+	// MissingSince is when 3CX stopped reporting the call, and MissedPolls the number of polls since then.
+	MissingSince time.Time
+	MissedPolls  int
+
+	// HeldSince is when the call was put on hold, and HoldDuration the total time it has been on hold before.
+	HeldSince    time.Time
+	HoldDuration time.Duration
+
+	// Deliveries holds the result per sink, "ok", "queued" or the first error, for the call history.
+	Deliveries map[string]string
+
+	// lastAnomaly prevents logging the same anomaly on every poll.
+	lastAnomaly string
+
+	// changed tells whether the lifecycle changed since the state was last saved.
+	changed bool
+}
+
+// newCallLifecycle starts the lifecycle of a call that was just noticed.
+func newCallLifecycle(call CallInformation) *callLifecycle {
+	return &callLifecycle{
+		Call:         call,
+		State:        CallStateNew,
+		History:      []CallState{CallStateNew},
+		AnsweredLegs: map[string]struct{}{},
+		changed:      true,
+	}
+}
+
+// canTransition checks whether the call may move to the given state.
+func (l *callLifecycle) canTransition(to CallState) bool {
+	for _, allowed := range callStateTransitions[l.State] {
+		if allowed == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transition moves the call to the given state at the given time. Invalid transitions are logged as anomalies and
+// leave the state as-is.
+func (l *callLifecycle) transition(to CallState, at time.Time) bool {
+	if !l.canTransition(to) {
+		l.anomaly(fmt.Sprintf("invalid transition from %s to %s", l.State, to))
+		return false
+	}
+
+	log.Trace().Str("call_id", l.Call.CallUID).Str("from_state", l.State.String()).Str("to_state", to.String()).Msg("Call state changed")
+	if l.State == CallStateHeld {
+		l.HoldDuration += at.Sub(l.HeldSince)
+		l.HeldSince = time.Time{}
+	} else if to == CallStateHeld {
+		l.HeldSince = at
+	}
+
+	l.State = to
+	l.History = append(l.History, to)
+	l.changed = true
+	return true
+}
+
+// hasBeen checks whether the call was ever in the given state.
+func (l *callLifecycle) hasBeen(state CallState) bool {
+	for _, s := range l.History {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
+
+// anomaly logs something unexpected about the call, which is then not reported to the sinks.
+func (l *callLifecycle) anomaly(reason string) {
+	if reason == l.lastAnomaly {
+		return
+	}
+	l.lastAnomaly = reason
+
+	log.Warn().
+		Str("call_id", l.Call.CallUID).
+		Str("state", l.State.String()).
+		Str("status", l.Call.Status).
+		Str("from", l.Call.CallFrom).
+		Str("to", l.Call.CallTo).
+		Msg("Call anomaly: " + reason)
+}
+
+// observedState translates the status reported by 3CX into the state the call should be in.
+func (z *ZammadBridge) observedState(call *CallInformation) CallState {
+	switch strings.ToLower(call.Status) {
+	case "talking":
+		// A call that is "Talking" to the queue is still waiting for an agent, and a call that is "Talking" to the
+		// voicemail was never answered by anyone
+		if z.isCallToQueue(*call) || z.isVoicemail(call) {
+			return CallStateRinging
+		}
+		return CallStateAnswered
+	case "hold", "held", "onhold":
+		return CallStateHeld
+	default:
+		// "Routing", "Ringing", "Dialing", "Transferring", ...
+		return CallStateRinging
+	}
+}
+
+// sendNewCall notifies the sinks about the new call, unless that already happened.
+func (z *ZammadBridge) sendNewCall(l *callLifecycle) {
+	if l.NewCallSent {
+		l.anomaly("duplicate newCall")
+		return
+	}
+
+	l.NewCallSent = true
+	l.changed = true
+	z.notifyNewCall(l)
+}
+
+// sendAnswer notifies the sinks that the current agent leg answered the call, unless that leg already did.
+func (z *ZammadBridge) sendAnswer(l *callLifecycle) {
+	if !l.NewCallSent {
+		l.anomaly("answer before newCall")
+		return
+	}
+
+	if _, ok := l.AnsweredLegs[l.Call.AgentNumber]; ok {
+		return
+	}
+
+	l.AnsweredLegs[l.Call.AgentNumber] = struct{}{}
+	l.changed = true
+	z.notifyAnswer(l)
+}
+
+// sendHangup notifies the sinks that the call has ended, unless that already happened.
+func (z *ZammadBridge) sendHangup(l *callLifecycle, outcome CallOutcome) {
+	if !l.NewCallSent {
+		l.anomaly("hangup before newCall")
+		return
+	}
+
+	if l.HangupSent {
+		l.anomaly("duplicate hangup")
+		return
+	}
+
+	l.HangupSent = true
+	l.changed = true
+	z.notifyHangup(l, outcome)
+}
+
+// CallSnapshot is a copy of an ongoing call, which readers can use without synchronization.
+type CallSnapshot struct {
+	Call       CallInformation `json:"call"`
+	State      string          `json:"state"`
+	Agents     []string        `json:"agents"`
+	InQueue    bool            `json:"in_queue"`
+	Legs       []CallLeg       `json:"legs"`
+	Conference []string        `json:"conference"`
+}
+
+// snapshot copies the lifecycle. The caller has to hold z.mu.
+func (l *callLifecycle) snapshot() CallSnapshot {
+	legs := make([]CallLeg, 0, len(l.Legs))
+	for _, key := range slices.Sorted(maps.Keys(l.Legs)) {
+		legs = append(legs, l.Legs[key])
+	}
+
+	return CallSnapshot{
+		Call:       l.Call,
+		State:      l.State.String(),
+		Agents:     append([]string(nil), l.Agents...),
+		InQueue:    l.InQueue,
+		Legs:       legs,
+		Conference: append([]string(nil), l.Conference...),
+	}
+}
+
+// Calls returns a snapshot of the ongoing calls, ordered by the time they were first seen.
+func (z *ZammadBridge) Calls() []CallSnapshot {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	calls := make([]CallSnapshot, 0, len(z.ongoingCalls))
+	for _, l := range z.ongoingCalls {
+		calls = append(calls, l.snapshot())
+	}
+
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].Call.FirstSeenAt.Before(calls[j].Call.FirstSeenAt)
+	})
+
+	return calls
+}
+
+// Call returns a snapshot of the ongoing call with the given 3CX call ID.
+func (z *ZammadBridge) Call(id json.Number) (CallSnapshot, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	l, ok := z.ongoingCalls[id]
+	if !ok {
+		return CallSnapshot{}, false
+	}
+
+	return l.snapshot(), true
+}
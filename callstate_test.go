@@ -0,0 +1,128 @@
+package zammadbridge
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+// TestCallStateTransitions reports calls with a sequence of agents and statuses, and checks the states the calls go
+// through. Together, the cases make every transition of callStateTransitions that advanceCall makes.
+func TestCallStateTransitions(t *testing.T) {
+	type poll struct {
+		agent  string
+		status string
+	}
+
+	tests := []struct {
+		name    string
+		polls   []poll
+		history []CallState
+	}{
+		{
+			name:    "answered after ringing",
+			polls:   []poll{{"150", "Ringing"}, {"150", "Talking"}},
+			history: []CallState{CallStateNew, CallStateRinging, CallStateAnswered},
+		},
+		{
+			name:    "answered at once",
+			polls:   []poll{{"150", "Talking"}},
+			history: []CallState{CallStateNew, CallStateAnswered},
+		},
+		{
+			name:    "held at once",
+			polls:   []poll{{"150", "Hold"}},
+			history: []CallState{CallStateNew, CallStateHeld},
+		},
+		{
+			name:    "held after ringing",
+			polls:   []poll{{"150", "Ringing"}, {"150", "Hold"}},
+			history: []CallState{CallStateNew, CallStateRinging, CallStateHeld},
+		},
+		{
+			name:    "held and resumed",
+			polls:   []poll{{"150", "Talking"}, {"150", "Hold"}, {"150", "Talking"}},
+			history: []CallState{CallStateNew, CallStateAnswered, CallStateHeld, CallStateAnswered},
+		},
+		{
+			name:    "transferred to a ringing agent",
+			polls:   []poll{{"150", "Talking"}, {"151", "Ringing"}, {"151", "Talking"}},
+			history: []CallState{CallStateNew, CallStateAnswered, CallStateTransferred, CallStateRinging, CallStateAnswered},
+		},
+		{
+			name:    "transferred to a talking agent",
+			polls:   []poll{{"150", "Talking"}, {"151", "Talking"}},
+			history: []CallState{CallStateNew, CallStateAnswered, CallStateTransferred, CallStateAnswered},
+		},
+		{
+			name:    "transferred to a holding agent",
+			polls:   []poll{{"150", "Talking"}, {"151", "Hold"}},
+			history: []CallState{CallStateNew, CallStateAnswered, CallStateTransferred, CallStateHeld},
+		},
+		{
+			name:    "transferred while held",
+			polls:   []poll{{"150", "Hold"}, {"151", "Ringing"}},
+			history: []CallState{CallStateNew, CallStateHeld, CallStateTransferred, CallStateRinging},
+		},
+		{
+			name:    "transferring keeps the call answered",
+			polls:   []poll{{"150", "Talking"}, {"150", "Transferring"}},
+			history: []CallState{CallStateNew, CallStateAnswered},
+		},
+	}
+
+	seen := map[[2]CallState]bool{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			config.Phone3CX.ExtensionDigits = 3
+			config.Phone3CX.TrunkDigits = 5
+			z := &ZammadBridge{
+				Config:       config,
+				Client3CX:    &stubAPI3CX{quiet: true},
+				ongoingCalls: map[json.Number]*callLifecycle{},
+			}
+
+			for _, p := range tt.polls {
+				call := CallInformation{ID: "1", CallerNumber: "12345", CalleeNumber: p.agent, Status: p.status}
+				err := z.ProcessCall(&call)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			l := z.ongoingCalls["1"]
+			if !slices.Equal(l.History, tt.history) {
+				t.Errorf("expected states %v, got %v", tt.history, l.History)
+			}
+
+			// The call ends once 3CX stops reporting it
+			for i := 0; i < 2; i++ {
+				err := z.RequestAndProcess()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if l.State != CallStateEnded {
+				t.Errorf("expected the call to end, got %s", l.State)
+			}
+
+			for i := 1; i < len(l.History); i++ {
+				seen[[2]CallState{l.History[i-1], l.History[i]}] = true
+			}
+		})
+	}
+
+	for from, targets := range callStateTransitions {
+		for _, to := range targets {
+			// Calls leave the new and transferred states in the same poll, so they never end in them
+			if (from == CallStateNew || from == CallStateTransferred) && to == CallStateEnded {
+				continue
+			}
+
+			if !seen[[2]CallState{from, to}] {
+				t.Errorf("transition from %s to %s is allowed, but not made", from, to)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	zammadbridge "github.com/qmexnetworks/3cx-zammad-bridge"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspects the configuration",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Checks the configuration and lists every problem, without connecting to 3CX or Zammad",
+	Args:  cobra.NoArgs,
+	// The problems are already listed
+	SilenceErrors: true,
+	// The configuration is loaded here, so that problems are reported instead of aborting
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := zammadbridge.LoadConfig(configLocations(), configOverrides()...)
+		if err != nil {
+			fmt.Println("The configuration cannot be loaded:")
+			fmt.Printf("  - %s\n", err)
+			return errors.New("invalid configuration")
+		}
+
+		err = c.Validate()
+		var invalid *zammadbridge.ValidationError
+		if errors.As(err, &invalid) {
+			fmt.Printf("The configuration has %d problem(s):\n", len(invalid.Problems))
+			for _, problem := range invalid.Problems {
+				fmt.Printf("  - %s\n", problem)
+			}
+			return errors.New("invalid configuration")
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Println("The configuration is valid")
+		return nil
+	},
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Prints the effective configuration, merged from all files and the environment, with the secrets redacted",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := yaml.Marshal(config.Redacted())
+		if err != nil {
+			return fmt.Errorf("unable to serialize configuration: %w", err)
+		}
+
+		for _, f := range config.Files() {
+			fmt.Printf("# %s\n", f)
+		}
+		fmt.Print(string(data))
+		return nil
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configShowCmd)
+}
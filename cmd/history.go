@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	zammadbridge "github.com/qmexnetworks/3cx-zammad-bridge"
+)
+
+var (
+	historyFile   string
+	historyFrom   string
+	historyTo     string
+	historyAgent  string
+	historyNumber string
+	historyMissed bool
+	historyOutput string
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Lists the finished calls from the call history",
+	Args:  cobra.NoArgs,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// The configuration is only needed to find the history file
+		if historyFile != "" {
+			return nil
+		}
+
+		return rootCmd.PersistentPreRunE(cmd, args)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := historyFile
+		if path == "" {
+			path = config.Bridge.HistoryFile
+		}
+		if path == "" {
+			return fmt.Errorf("no history file configured (Bridge.history_file or --file)")
+		}
+
+		var filter = zammadbridge.HistoryFilter{
+			Agent:      historyAgent,
+			Number:     historyNumber,
+			MissedOnly: historyMissed,
+		}
+
+		var err error
+		filter.From, err = parseHistoryTime(historyFrom, false)
+		if err != nil {
+			return fmt.Errorf("invalid --from: %w", err)
+		}
+		filter.To, err = parseHistoryTime(historyTo, true)
+		if err != nil {
+			return fmt.Errorf("invalid --to: %w", err)
+		}
+
+		records, err := queryHistory(path, filter)
+		if err != nil {
+			return err
+		}
+
+		switch historyOutput {
+		case "table":
+			return writeHistoryTable(records)
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if records == nil {
+				records = []zammadbridge.HistoryRecord{}
+			}
+			return enc.Encode(records)
+		case "csv":
+			return writeHistoryCSV(records)
+		default:
+			return fmt.Errorf("unknown output format %q", historyOutput)
+		}
+	},
+}
+
+func init() {
+	historyCmd.Flags().StringVar(&historyFile, "file", "", "history database (default Bridge.history_file)")
+	historyCmd.Flags().StringVar(&historyFrom, "from", "", "only calls that ended at or after this date (2006-01-02) or time (RFC 3339)")
+	historyCmd.Flags().StringVar(&historyTo, "to", "", "only calls that ended at or before this date (inclusive) or time")
+	historyCmd.Flags().StringVar(&historyAgent, "agent", "", "only calls of this agent (extension or name)")
+	historyCmd.Flags().StringVar(&historyNumber, "number", "", "only calls with an external number containing this")
+	historyCmd.Flags().BoolVar(&historyMissed, "missed", false, "only missed calls")
+	historyCmd.Flags().StringVarP(&historyOutput, "output", "o", "table", "output format: \"table\", \"json\" or \"csv\"")
+}
+
+// queryHistory reads the records from the history file. While the bridge is running, it has the file open, and the
+// records are requested from the bridge API instead.
+func queryHistory(path string, filter zammadbridge.HistoryFilter) ([]zammadbridge.HistoryRecord, error) {
+	history, err := zammadbridge.OpenHistory(path, true)
+	if errors.Is(err, zammadbridge.ErrHistoryInUse) && config != nil && config.Bridge.ApiListen != "" {
+		return queryHistoryAPI(filter)
+	}
+	if errors.Is(err, zammadbridge.ErrHistoryInUse) {
+		return nil, fmt.Errorf("%w - configure Bridge.api_listen to read it while the bridge is running", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer history.Close()
+
+	return history.Query(filter)
+}
+
+// queryHistoryAPI requests the records from the API of the running bridge.
+func queryHistoryAPI(filter zammadbridge.HistoryFilter) ([]zammadbridge.HistoryRecord, error) {
+	host, port, err := net.SplitHostPort(config.Bridge.ApiListen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Bridge.api_listen: %w", err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	query := url.Values{}
+	if !filter.From.IsZero() {
+		query.Set("from", filter.From.Format(time.RFC3339Nano))
+	}
+	if !filter.To.IsZero() {
+		query.Set("to", filter.To.Format(time.RFC3339Nano))
+	}
+	if filter.Agent != "" {
+		query.Set("agent", filter.Agent)
+	}
+	if filter.Number != "" {
+		query.Set("number", filter.Number)
+	}
+	if filter.MissedOnly {
+		query.Set("missed", "true")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+net.JoinHostPort(host, port)+"/history?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare history request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+config.Bridge.ApiSecret)
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to request the history from the bridge: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected response from the bridge API (HTTP %d): %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	var records []zammadbridge.HistoryRecord
+	err = json.NewDecoder(resp.Body).Decode(&records)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse history response: %w", err)
+	}
+
+	return records, nil
+}
+
+// parseHistoryTime parses a date in local time or an RFC 3339 time. A date used as the end of the range includes
+// the whole day.
+func parseHistoryTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+var historyColumns = []string{"ended_at", "direction", "number", "agent", "queue", "ring", "talk", "hold", "outcome", "missed", "deliveries"}
+
+// historyRow formats the record for the table and CSV output.
+func historyRow(r zammadbridge.HistoryRecord) []string {
+	var deliveries []string
+	for sink, result := range r.Deliveries {
+		deliveries = append(deliveries, sink+": "+result)
+	}
+	sort.Strings(deliveries)
+
+	agent := r.AgentNumber
+	if r.AgentName != "" {
+		agent += " (" + r.AgentName + ")"
+	}
+
+	return []string{
+		r.EndedAt.Local().Format(time.DateTime),
+		r.Direction,
+		r.ExternalNumber,
+		agent,
+		r.Queue,
+		strconv.FormatFloat(r.RingSeconds, 'f', 0, 64),
+		strconv.FormatFloat(r.TalkSeconds, 'f', 0, 64),
+		strconv.FormatFloat(r.HoldSeconds, 'f', 0, 64),
+		r.Outcome,
+		strconv.FormatBool(r.Missed),
+		strings.Join(deliveries, ", "),
+	}
+}
+
+func writeHistoryTable(records []zammadbridge.HistoryRecord) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for i, column := range historyColumns {
+		if i > 0 {
+			fmt.Fprint(w, "\t")
+		}
+		fmt.Fprint(w, column)
+	}
+	fmt.Fprintln(w)
+
+	for _, r := range records {
+		for i, value := range historyRow(r) {
+			if i > 0 {
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprint(w, value)
+		}
+		fmt.Fprintln(w)
+	}
+
+	return w.Flush()
+}
+
+func writeHistoryCSV(records []zammadbridge.HistoryRecord) error {
+	w := csv.NewWriter(os.Stdout)
+	_ = w.Write(historyColumns)
+	for _, r := range records {
+		_ = w.Write(historyRow(r))
+	}
+
+	w.Flush()
+	return w.Error()
+}
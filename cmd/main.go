@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"time"
 
@@ -12,16 +13,33 @@ import (
 )
 
 var (
-	client *zammadbridge.ZammadBridge
+	config *zammadbridge.Config
 )
 
 var rootCmd = &cobra.Command{
 	Use:          "zammadbridge",
 	Short:        "3cx-zammad-bridge is a bridge that listens on 3cx to forward information to zammad",
 	SilenceUsage: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		config, err = zammadbridge.LoadConfig(configLocations(), configOverrides()...)
+		if err != nil {
+			return fmt.Errorf("unable to load configuration: %w", err)
+		}
+
+		if dryRun {
+			config.Zammad.DryRun = true
+		}
+
+		return nil
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		// Do Stuff Here
-		err := client.Listen()
+		client, err := zammadbridge.NewZammadBridge(config)
+		if err != nil {
+			return err
+		}
+
+		err = client.Listen()
 		if err != nil {
 			return err
 			//log.Fatalln("Fatal error:", err.Error())
@@ -32,12 +50,36 @@ var rootCmd = &cobra.Command{
 }
 
 var (
-	verboseMode          bool
-	traceMode            bool
-	logFormat            string
-	customConfigLocation string
+	verboseMode           bool
+	traceMode             bool
+	logFormat             string
+	customConfigLocations []string
+	dryRun                bool
 )
 
+// configLocations returns the config files to look for, in order of preference. Further config files given on the
+// command line are merged on top, see configOverrides.
+func configLocations() []string {
+	if len(customConfigLocations) > 0 {
+		return customConfigLocations[:1]
+	}
+
+	return []string{
+		"config.yaml",
+		"/etc/3cx-zammad-bridge/config.yaml",
+		"//3cx-zammad-bridge/config.yaml",
+	}
+}
+
+// configOverrides returns the config files that are merged on top of the first one, in order.
+func configOverrides() []string {
+	if len(customConfigLocations) > 1 {
+		return customConfigLocations[1:]
+	}
+
+	return nil
+}
+
 func setupLogging() {
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	if verboseMode {
@@ -65,33 +107,14 @@ func main() {
 	rootCmd.PersistentFlags().BoolVarP(&verboseMode, "verbose", "v", false, "verbose output")
 	rootCmd.PersistentFlags().BoolVarP(&traceMode, "trace", "", false, "trace output, super verbose")
 	rootCmd.PersistentFlags().StringVarP(&logFormat, "log-format", "f", "json", "log format: \"json\" or \"plain\"")
-	rootCmd.PersistentFlags().StringVarP(&customConfigLocation, "config", "c", "", "custom config file path (default \"/etc/3cx-zammad-bridge/config.yaml\")")
-	_ = rootCmd.ParseFlags(os.Args)
-
-	setupLogging()
-
-	var configLocations = []string{
-		"config.yaml",
-		"/etc/3cx-zammad-bridge/config.yaml",
-		"//3cx-zammad-bridge/config.yaml",
-	}
-	if customConfigLocation != "" {
-		configLocations = []string{customConfigLocation}
-	}
-
-	c, err := zammadbridge.LoadConfigFromYaml(
-		configLocations...,
-	)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Unable to load configuration")
-	}
-
-	client, err = zammadbridge.NewZammadBridge(c)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Unable to create Zammad bridge")
-	}
+	rootCmd.PersistentFlags().StringArrayVarP(&customConfigLocations, "config", "c", nil, "custom config file path (default \"/etc/3cx-zammad-bridge/config.yaml\"), repeat to merge further files on top")
+	rootCmd.PersistentFlags().BoolVarP(&dryRun, "dry-run", "", false, "record the Zammad payloads (to stdout or Zammad.dry_run_output) instead of sending them")
+	rootCmd.AddCommand(historyCmd)
+	rootCmd.AddCommand(replayCmd)
+	rootCmd.AddCommand(configCmd)
+	cobra.OnInitialize(setupLogging)
 
-	err = rootCmd.Execute()
+	err := rootCmd.Execute()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Unable to execute command")
 		os.Exit(1)
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	zammadbridge "github.com/qmexnetworks/3cx-zammad-bridge"
+)
+
+var (
+	replaySpeed float64
+	replayDiff  bool
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <journal file>",
+	Short: "Runs recorded 3CX traffic through the bridge and prints the Zammad events that would have been sent",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entries, err := zammadbridge.ReadJournal(args[0])
+		if err != nil {
+			return err
+		}
+
+		var output io.Writer = os.Stdout
+		if replayDiff {
+			output = nil
+		}
+
+		replayed, err := zammadbridge.Replay(*config, entries, replaySpeed, output)
+		if err != nil {
+			return err
+		}
+
+		if !replayDiff {
+			return nil
+		}
+
+		differences := printPayloadDiff(zammadbridge.RecordedPayloads(entries), replayed)
+		if differences > 0 {
+			return fmt.Errorf("%d events differ between the recording and the replay", differences)
+		}
+
+		fmt.Println("The replay sent the same events as the recording")
+		return nil
+	},
+}
+
+func init() {
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1, "playback speed: 1 is the original timing, 0 as fast as possible")
+	replayCmd.Flags().BoolVar(&replayDiff, "diff", false, "compare the events with those that were actually sent, as recorded in the journal")
+}
+
+// printPayloadDiff prints the payloads in the order of a longest common subsequence, prefixing those that were only
+// recorded with "-" and those that only the replay sent with "+". It returns the number of differing payloads.
+func printPayloadDiff(recorded, replayed []json.RawMessage) int {
+	n, m := len(recorded), len(replayed)
+	common := make([][]int, n+1)
+	for i := range common {
+		common[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if string(recorded[i]) == string(replayed[j]) {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	var differences int
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && string(recorded[i]) == string(replayed[j]):
+			fmt.Printf("  %s\n", recorded[i])
+			i++
+			j++
+		case j < m && (i == n || common[i][j+1] >= common[i+1][j]):
+			fmt.Printf("+ %s\n", replayed[j])
+			differences++
+			j++
+		default:
+			fmt.Printf("- %s\n", recorded[i])
+			differences++
+			i++
+		}
+	}
+
+	return differences
+}
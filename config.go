@@ -1,8 +1,11 @@
 package zammadbridge
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v2"
@@ -11,6 +14,24 @@ import (
 type Config struct {
 	Bridge struct {
 		PollInterval float64 `yaml:"poll_interval"`
+
+		// EndAfterPolls is the number of successful polls (default 2) in which 3CX must not report a call before it is
+		// considered ended, and EndAfter the number of seconds it must be missing at least. This prevents a single
+		// incomplete response from ending the call.
+		EndAfterPolls int     `yaml:"end_after_polls"`
+		EndAfter      float64 `yaml:"end_after"`
+
+		// StateFile records the calls that are open in Zammad, such that they can be resumed or closed after a restart.
+		StateFile string `yaml:"state_file"`
+
+		// HistoryFile is the database in which every finished call is recorded, see the history command.
+		HistoryFile string `yaml:"history_file"`
+
+		// ApiListen is the address of the HTTP API of the bridge (e.g. ":8080"), which is disabled when empty.
+		// Requests need to present ApiSecret.
+		ApiListen     string `yaml:"api_listen"`
+		ApiSecret     string `yaml:"api_secret"`
+		ApiSecretFile string `yaml:"api_secret_file"`
 	} `yaml:"Bridge"`
 	Phone3CX struct {
 		User            string `yaml:"user"`
@@ -23,32 +44,218 @@ type Config struct {
 		TrunkDigits     int    `yaml:"trunk_digits"`
 		QueueExtension  int    `yaml:"queue_extension"`
 		CountryPrefix   string `yaml:"country_prefix"`
+
+		// PassFile and ClientSecretFile read the secrets from files instead, e.g. Docker or Kubernetes secrets,
+		// see Config.LoadSecrets.
+		PassFile         string `yaml:"pass_file"`
+		ClientSecretFile string `yaml:"client_secret_file"`
+
+		// VoicemailExtensions are the extensions of voicemail boxes and digital receptionists. Calls that reach
+		// them are reported as missed instead of answered.
+		VoicemailExtensions []string `yaml:"voicemail_extensions"`
+		// VoicemailDNTypes are the v20 DN types that are treated like VoicemailExtensions, see DefaultVoicemailDNTypes
+		VoicemailDNTypes []string `yaml:"voicemail_dn_types"`
+
+		Transport TransportConfig `yaml:"transport"`
 	} `yaml:"3CX"`
 	Zammad struct {
 		Endpoint            string `yaml:"endpoint"`
+		EndpointFile        string `yaml:"endpoint_file"`
 		LogMissedQueueCalls bool   `yaml:"log_missed_queue_calls"`
+
+		// Token is sent in the Authorization header, as "Bearer <token>" or, with token_type "token",
+		// as "Token token=<token>" (a Zammad HTTP token). It allows keeping the secret out of the endpoint URL.
+		Token     string `yaml:"token"`
+		TokenFile string `yaml:"token_file"`
+		TokenType string `yaml:"token_type"`
+
+		// ApiURL and ApiToken give access to the REST API of Zammad. ApiURL defaults to the host of the Endpoint.
+		ApiURL       string `yaml:"api_url"`
+		ApiToken     string `yaml:"api_token"`
+		ApiTokenFile string `yaml:"api_token_file"`
+
+		// Users maps 3CX extensions to Zammad logins. Extensions that are not listed are looked up in Zammad
+		// by UserLookupAttribute (e.g. "phone"), if configured.
+		Users               map[string]string `yaml:"users"`
+		UserLookupAttribute string            `yaml:"user_lookup_attribute"`
+
+		// DryRun writes the payloads to DryRunOutput (a file, or "-" for stdout) instead of sending them to Zammad.
+		DryRun       bool   `yaml:"dry_run"`
+		DryRunOutput string `yaml:"dry_run_output"`
+
+		// HangupCauses overrides the Zammad cause that is reported for an outcome, see DefaultHangupCauses
+		HangupCauses map[string]string `yaml:"hangup_causes"`
+
+		Transport TransportConfig `yaml:"transport"`
 	} `yaml:"Zammad"`
+	Webhooks   []WebhookConfig `yaml:"Webhooks"`
+	Recordings RecordingConfig `yaml:"Recordings"`
+	Journal    JournalConfig   `yaml:"Journal"`
+
+	// secrets are the files the secrets were read from, see LoadSecrets.
+	secrets []*secretSource
+
+	// locations and overrides are the files the configuration was loaded from, see LoadConfigFromYaml, and sources
+	// the files and directories it was read from, such that it can be reloaded, see ZammadBridge.reload.
+	locations []string
+	overrides []string
+	sources   []*configSource
 }
 
-// LoadConfigFromYaml tries the provided files for a valid YAML configuration file.
-// It uses the first file it can parse, and only that file.
-func LoadConfigFromYaml(filenames ...string) (*Config, error) {
+// DropInDirectory is the directory next to the configuration file with further configuration files, e.g. conf.d/*.yaml.
+const DropInDirectory = "conf.d"
+
+// LoadConfigFromYaml reads the configuration from the first of the locations that exists, and merges these files on
+// top of it, see mergeYaml:
+//
+//  1. the files in the DropInDirectory next to it, in the order of their names
+//  2. the overrides, in the given order
+//
+// Unknown keys are errors, such that typos do not go unnoticed. Overrides without any of the locations are an error.
+func LoadConfigFromYaml(locations []string, overrides ...string) (*Config, error) {
+	var files []string
+	var dropIns string
+	for _, f := range locations {
+		if _, err := os.Stat(f); err == nil {
+			dropIns = filepath.Join(filepath.Dir(f), DropInDirectory)
+			matches, _ := filepath.Glob(filepath.Join(dropIns, "*.yaml"))
+			files = append(append(files, f), matches...)
+			break
+		}
+	}
+	if len(files) == 0 && len(overrides) > 0 {
+		// The overrides are only a part of the configuration
+		return nil, fmt.Errorf("unable to find the base configuration %s for %s", strings.Join(locations, ", "), strings.Join(overrides, ", "))
+	}
+	files = append(files, overrides...)
+
+	if len(files) == 0 {
+		return nil, errNoConfigFile
+	}
+
 	config := new(Config)
+	merged := map[interface{}]interface{}{}
+	for _, f := range files {
+		source, err := newConfigSource(f)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read configuration: %w", err)
+		}
 
-	for _, f := range filenames {
 		b, err := os.ReadFile(f)
 		if err != nil {
-			continue // hopefully other files will work out?
+			return nil, fmt.Errorf("unable to read configuration: %w", err)
 		}
 
-		err = yaml.Unmarshal(b, config)
+		// Every file is checked on its own, such that the errors refer to its lines
+		err = yaml.UnmarshalStrict(b, new(Config))
 		if err != nil {
-			log.Warn().Err(err).Str("file", f).Msg("Unable to parse YAML config")
-			continue // hopefully other files will work out?
+			return nil, fmt.Errorf("unable to parse %s: %w", f, yamlError(err))
 		}
 
-		return config, nil
+		var layer map[interface{}]interface{}
+		err = yaml.Unmarshal(b, &layer)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", f, err)
+		}
+		mergeYaml(merged, layer)
+
+		log.Debug().Str("file", f).Msg("Loaded configuration")
+		config.sources = append(config.sources, source)
+	}
+
+	b, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("unable to merge configuration: %w", err)
+	}
+
+	err = yaml.UnmarshalStrict(b, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to merge configuration: %w", yamlError(err))
+	}
+
+	// Drop-in files that are added later are noticed by the change of the directory
+	if source, err := newConfigSource(dropIns); err == nil {
+		source.dir = true
+		config.sources = append(config.sources, source)
+	}
+
+	return config, nil
+}
+
+// mergeYaml merges the YAML document layer into base. Sections and maps are merged key by key, other values
+// (including lists, such as Webhooks) are replaced as a whole.
+func mergeYaml(base map[interface{}]interface{}, layer map[interface{}]interface{}) {
+	for k, v := range layer {
+		if section, ok := v.(map[interface{}]interface{}); ok {
+			if baseSection, ok := base[k].(map[interface{}]interface{}); ok {
+				mergeYaml(baseSection, section)
+				continue
+			}
+		}
+
+		base[k] = v
+	}
+}
+
+// Files returns the configuration files that were merged, in order.
+func (c *Config) Files() []string {
+	var files []string
+	for _, source := range c.sources {
+		if !source.dir {
+			files = append(files, source.path)
+		}
+	}
+
+	return files
+}
+
+// errNoConfigFile is returned when none of the configuration files exist.
+var errNoConfigFile = errors.New("unable to find configuration files")
+
+// yamlError shortens the errors of the YAML parser, which would otherwise include the full definition of the
+// sections of Config, e.g. "line 3: field pol_interval not found in type struct { PollInterval float64 ... }".
+func yamlError(err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+
+	problems := make([]string, len(typeErr.Errors))
+	for i, e := range typeErr.Errors {
+		if cut, _, ok := strings.Cut(e, " in type struct {"); ok {
+			e = cut
+		}
+		problems[i] = e
+	}
+
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// LoadConfig loads the configuration from the YAML files, see LoadConfigFromYaml, and applies the environment
+// variables on top, see ApplyEnv, and reads the secrets from files, see LoadSecrets. Without any file, the
+// configuration comes from the environment alone.
+func LoadConfig(locations []string, overrides ...string) (*Config, error) {
+	config, err := LoadConfigFromYaml(locations, overrides...)
+	if err != nil {
+		if !errors.Is(err, errNoConfigFile) || !hasEnvConfig(os.Environ()) {
+			return nil, err
+		}
+
+		log.Info().Msg("No configuration file found - using the environment only")
+		config = new(Config)
+	}
+
+	err = config.ApplyEnv(os.Environ())
+	if err != nil {
+		return nil, fmt.Errorf("unable to apply environment variables: %w", err)
+	}
+
+	err = config.LoadSecrets()
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("unable to find configuration files")
+	config.locations = locations
+	config.overrides = overrides
+	return config, nil
 }
@@ -0,0 +1,191 @@
+package zammadbridge
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EnvPrefix starts the names of the environment variables that override the configuration. The name continues with
+// the YAML keys in upper case, joined by underscores, e.g. ZAMMADBRIDGE_3CX_CLIENT_SECRET or
+// ZAMMADBRIDGE_ZAMMAD_TRANSPORT_CA_FILE.
+const EnvPrefix = "ZAMMADBRIDGE"
+
+// ApplyEnv overrides the configuration with the environment variables (as "KEY=value") that start with EnvPrefix.
+// Lists are separated by commas, maps are written as "key=value,key=value", and lists of sections are indexed,
+// e.g. ZAMMADBRIDGE_WEBHOOKS_0_URL.
+func (c *Config) ApplyEnv(environ []string) error {
+	env := map[string]string{}
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(key, EnvPrefix+"_") {
+			env[key] = value
+		}
+	}
+
+	used := map[string]bool{}
+	err := applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, env, used)
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+	for key := range env {
+		if !used[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		log.Warn().Strs("variables", unknown).Msg("Ignoring unknown configuration environment variables")
+	}
+
+	return nil
+}
+
+// hasEnvConfig checks whether any environment variable configures the bridge.
+func hasEnvConfig(environ []string) bool {
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, EnvPrefix+"_") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyEnv sets the fields of the struct v from the environment variables below the given prefix.
+func applyEnv(v reflect.Value, prefix string, env map[string]string, used map[string]bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		err := applyEnvValue(v.Field(i), prefix+"_"+strings.ToUpper(tag), env, used)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyEnvValue sets a single field from the environment variable with the given name, or from those below it.
+func applyEnvValue(field reflect.Value, name string, env map[string]string, used map[string]bool) error {
+	if field.Kind() == reflect.Struct {
+		return applyEnv(field, name, env, used)
+	}
+
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
+		// Configured sections can be overridden individually, further sections are appended
+		for i := 0; i < field.Len() || hasEnvBelow(env, name+"_"+strconv.Itoa(i)); i++ {
+			if i >= field.Len() {
+				field.Set(reflect.Append(field, reflect.New(field.Type().Elem()).Elem()))
+			}
+
+			err := applyEnv(field.Index(i), name+"_"+strconv.Itoa(i), env, used)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	value, ok := env[name]
+	if !ok {
+		return nil
+	}
+	used[name] = true
+
+	err := setEnvValue(field, value)
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// hasEnvBelow checks whether any environment variable starts with the given prefix.
+func hasEnvBelow(env map[string]string, prefix string) bool {
+	for key := range env {
+		if strings.HasPrefix(key, prefix+"_") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setEnvValue parses the value of an environment variable into the field.
+func setEnvValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", field.Type())
+		}
+
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	case reflect.Pointer:
+		// An optional value, e.g. to tell 0 apart from not set
+		v := reflect.New(field.Type().Elem())
+		err := setEnvValue(v.Elem(), value)
+		if err != nil {
+			return err
+		}
+		field.Set(v)
+	case reflect.Map:
+		if field.Type().Key().Kind() != reflect.String || field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map type %s", field.Type())
+		}
+
+		m := map[string]string{}
+		for _, item := range strings.Split(value, ",") {
+			if strings.TrimSpace(item) == "" {
+				continue
+			}
+
+			k, v, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", item)
+			}
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		field.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
@@ -9,6 +9,7 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/rs/zerolog v1.34.0
 	github.com/spf13/cobra v1.10.1
+	go.etcd.io/bbolt v1.4.3
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -0,0 +1,205 @@
+package zammadbridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// historyBucket is the bbolt bucket that holds the finished calls, keyed by end time and call ID.
+var historyBucket = []byte("calls")
+
+// HistoryRecord is a finished call, as stored in the call history.
+type HistoryRecord struct {
+	CallUID        string    `json:"call_id"`
+	StartedAt      time.Time `json:"started_at"`
+	EndedAt        time.Time `json:"ended_at"`
+	Direction      string    `json:"direction"`
+	ExternalNumber string    `json:"external_number"`
+	AgentNumber    string    `json:"agent_number"`
+	AgentName      string    `json:"agent_name"`
+	Queue          string    `json:"queue,omitempty"`
+	RingSeconds    float64   `json:"ring_seconds"`
+	TalkSeconds    float64   `json:"talk_seconds"`
+	HoldSeconds    float64   `json:"hold_seconds"`
+	Outcome        string    `json:"outcome"`
+	Missed         bool      `json:"missed"`
+
+	// Conference lists the agents that talked on the call besides AgentNumber.
+	Conference []string `json:"conference,omitempty"`
+
+	// Deliveries holds the result per sink, e.g. {"zammad": "ok", "webhook https://example.com": "queued"}
+	Deliveries map[string]string `json:"deliveries"`
+}
+
+// HistoryFilter selects records from the call history. Empty fields do not filter.
+type HistoryFilter struct {
+	From       time.Time
+	To         time.Time
+	Agent      string
+	Number     string
+	MissedOnly bool
+}
+
+// matches checks whether the record passes the filter, apart from the time range.
+func (f HistoryFilter) matches(r HistoryRecord) bool {
+	if f.Agent != "" && r.AgentNumber != f.Agent && !strings.EqualFold(r.AgentName, f.Agent) {
+		return false
+	}
+
+	if f.Number != "" && !strings.Contains(r.ExternalNumber, f.Number) {
+		return false
+	}
+
+	if f.MissedOnly && !r.Missed {
+		return false
+	}
+
+	return true
+}
+
+// History is the local database of finished calls. The bridge keeps it open while it runs, and writes the records in
+// the background, such that finishing a call does not wait for the disk. Other processes read it through the bridge
+// API in the meantime, see the history command.
+type History struct {
+	db      *bolt.DB
+	records chan HistoryRecord
+}
+
+// ErrHistoryInUse is returned when the history database is opened while another process, e.g. the bridge, has it open.
+var ErrHistoryInUse = errors.New("the history database is in use by another process")
+
+// OpenHistory opens the database at the given path, which is created if it does not exist yet.
+func OpenHistory(path string, readOnly bool) (*History, error) {
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, ErrHistoryInUse
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open history database: %w", err)
+	}
+
+	h := &History{db: db}
+	if !readOnly {
+		h.records = make(chan HistoryRecord, 100)
+		go h.writeRecords()
+	}
+
+	return h, nil
+}
+
+// Close closes the database. Records that are still queued are not written.
+func (h *History) Close() error {
+	return h.db.Close()
+}
+
+// Record queues a finished call to be stored.
+func (h *History) Record(record HistoryRecord) {
+	h.records <- record
+}
+
+// writeRecords stores the queued records, until the database is closed.
+func (h *History) writeRecords() {
+	for record := range h.records {
+		err := h.write(record)
+		if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("call_id", record.CallUID).Msg("Unable to record call history")
+		}
+	}
+}
+
+// write stores a finished call.
+func (h *History) write(record HistoryRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to serialize history record: %w", err)
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return fmt.Errorf("unable to create history bucket: %w", err)
+		}
+
+		return bucket.Put(historyKey(record.EndedAt, record.CallUID), value)
+	})
+}
+
+// Query returns the finished calls matching the filter, ordered by the time they ended.
+func (h *History) Query(filter HistoryFilter) ([]HistoryRecord, error) {
+	var records []HistoryRecord
+	err := h.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Seek(historyKey(filter.From, "")); k != nil; k, v = c.Next() {
+			var record HistoryRecord
+			err := json.Unmarshal(v, &record)
+			if err != nil {
+				return fmt.Errorf("unable to parse history record %q: %w", k, err)
+			}
+
+			if !filter.To.IsZero() && record.EndedAt.After(filter.To) {
+				break
+			}
+
+			if filter.matches(record) {
+				records = append(records, record)
+			}
+		}
+
+		return nil
+	})
+
+	return records, err
+}
+
+// historyKey builds a key that sorts chronologically.
+func historyKey(endedAt time.Time, callUID string) []byte {
+	return []byte(endedAt.UTC().Format("2006-01-02T15:04:05.000000000Z") + "/" + callUID)
+}
+
+// historyRecord describes the finished call for the history. The caller has to hold z.mu.
+func (z *ZammadBridge) historyRecord(l *callLifecycle, outcome CallOutcome) *HistoryRecord {
+	call := l.Call
+	hold := l.HoldDuration
+	if !l.HeldSince.IsZero() {
+		hold += call.EndedAt.Sub(l.HeldSince)
+	}
+
+	record := &HistoryRecord{
+		CallUID:        call.CallUID,
+		StartedAt:      call.FirstSeenAt,
+		EndedAt:        call.EndedAt,
+		Direction:      call.Direction,
+		ExternalNumber: call.ExternalNumber,
+		AgentNumber:    call.AgentNumber,
+		AgentName:      call.AgentName,
+		RingSeconds:    call.RingDuration().Seconds(),
+		TalkSeconds:    max(call.TalkDuration()-hold, 0).Seconds(),
+		HoldSeconds:    hold.Seconds(),
+		Outcome:        string(outcome),
+		Missed:         call.Direction == "Inbound" && !l.hasBeen(CallStateAnswered),
+		Conference:     slices.Clone(l.Conference),
+		Deliveries:     maps.Clone(l.Deliveries),
+	}
+	if l.InQueue {
+		record.Queue = strconv.Itoa(z.Config.Phone3CX.QueueExtension)
+	}
+
+	return record
+}
@@ -0,0 +1,235 @@
+package zammadbridge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// JournalConfig configures the journal of raw 3CX traffic and Zammad payloads.
+type JournalConfig struct {
+	// Directory receives one gzipped JSON lines file per hour. The journal is disabled when empty.
+	Directory string `yaml:"directory"`
+
+	// Retention is the number of hours the files are kept (default 168, i.e. a week).
+	Retention float64 `yaml:"retention"`
+}
+
+// The kinds of entries in the journal.
+const (
+	// JournalKindActiveCalls is a response of /api/activeCalls (before v20).
+	JournalKindActiveCalls = "3cx-active-calls"
+	// JournalKindCallControl is a response of /callcontrol (v20 and above).
+	JournalKindCallControl = "3cx-callcontrol"
+	// JournalKindWebsocket is a frame received on the 3CX websocket (v20 and above).
+	JournalKindWebsocket = "3cx-ws"
+	// JournalKindZammad is a payload sent to the CTI endpoint of Zammad.
+	JournalKindZammad = "zammad"
+	// JournalKindZammadDryRun is a payload that was only recorded in dry-run mode, and never reached Zammad.
+	JournalKindZammadDryRun = "zammad-dry-run"
+)
+
+// journalFileFormat names the files of the journal after the hour (UTC) they cover. A bridge that starts again within
+// the same hour adds a counter, e.g. "journal-2024053114-1.jsonl.gz".
+const journalFileFormat = "journal-2006010215"
+
+// JournalEntry is a single line of the journal.
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+
+	// Data is the raw JSON, or a JSON string if it was not JSON. It is left out if Same is set.
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// Same tells that the data is identical to the previous entry of the same kind, which keeps polls compact.
+	Same bool `json:"same,omitempty"`
+
+	// Error is set if the request failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Journal records raw 3CX responses and the payloads sent to Zammad, such that what happened to a call can be
+// reconstructed, or replayed. All methods may be called on a nil *Journal, which records nothing.
+type Journal struct {
+	Config JournalConfig
+
+	mu       sync.Mutex
+	file     *os.File
+	gz       *gzip.Writer
+	fileHour time.Time
+
+	// previous is the last data per kind, see JournalEntry.Same
+	previous map[string][]byte
+}
+
+// NewJournal creates a journal in the configured directory, applying the defaults of the configuration.
+func NewJournal(config JournalConfig) (*Journal, error) {
+	if config.Retention == 0 {
+		config.Retention = 168
+	}
+
+	err := os.MkdirAll(config.Directory, 0o750)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create journal directory: %w", err)
+	}
+
+	log.Info().Str("directory", config.Directory).Float64("retention_hours", config.Retention).Msg("Recording journal")
+
+	return &Journal{
+		Config:   config,
+		previous: map[string][]byte{},
+	}, nil
+}
+
+// Record adds an entry to the journal, and returns the time of the entry. A failure to record is logged, but does
+// not affect the bridge.
+func (j *Journal) Record(kind string, data []byte, reqErr error) time.Time {
+	if j == nil {
+		return time.Now()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry := JournalEntry{
+		Time: time.Now(),
+		Kind: kind,
+	}
+	if reqErr != nil {
+		entry.Error = reqErr.Error()
+	}
+
+	hour := entry.Time.UTC().Truncate(time.Hour)
+	if j.file == nil || !hour.Equal(j.fileHour) {
+		err := j.rotate(hour)
+		if err != nil {
+			log.Error().Err(err).Str("directory", j.Config.Directory).Msg("Unable to rotate journal")
+			return entry.Time
+		}
+	}
+
+	if data != nil && bytes.Equal(data, j.previous[kind]) {
+		entry.Same = true
+	} else if data != nil {
+		j.previous[kind] = bytes.Clone(data)
+		entry.Data = journalData(data)
+	}
+
+	err := j.write(entry)
+	if err != nil {
+		log.Error().Err(err).Str("directory", j.Config.Directory).Msg("Unable to write journal")
+	}
+
+	return entry.Time
+}
+
+// journalData keeps JSON as-is, and stores anything else as a JSON string.
+func journalData(data []byte) json.RawMessage {
+	if json.Valid(data) {
+		var compact bytes.Buffer
+		if json.Compact(&compact, data) == nil {
+			return compact.Bytes()
+		}
+	}
+
+	quoted, _ := json.Marshal(string(data))
+	return quoted
+}
+
+// write appends the entry to the current file. The file is flushed after every entry, such that it can be read
+// while the bridge is running, and little is lost on a crash.
+func (j *Journal) write(entry JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("unable to serialize journal entry: %w", err)
+	}
+
+	_, err = j.gz.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("unable to write journal entry: %w", err)
+	}
+
+	return j.gz.Flush()
+}
+
+// rotate closes the current file, creates the file of the given hour and removes the files that expired. Data is
+// never marked Same across files, such that every file can be replayed on its own.
+func (j *Journal) rotate(hour time.Time) error {
+	j.close()
+
+	var f *os.File
+	for i := 0; f == nil; i++ {
+		name := hour.Format(journalFileFormat)
+		if i > 0 {
+			name += fmt.Sprintf("-%d", i)
+		}
+
+		var err error
+		f, err = os.OpenFile(filepath.Join(j.Config.Directory, name+".jsonl.gz"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("unable to create journal file: %w", err)
+		}
+	}
+
+	j.file = f
+	j.gz = gzip.NewWriter(f)
+	j.fileHour = hour
+	j.previous = map[string][]byte{}
+
+	j.removeExpired(hour)
+	return nil
+}
+
+// close finishes the current file, if any.
+func (j *Journal) close() {
+	if j.file == nil {
+		return
+	}
+
+	err := j.gz.Close()
+	if err != nil {
+		log.Warn().Err(err).Str("file", j.file.Name()).Msg("Unable to finish journal file")
+	}
+	_ = j.file.Close()
+
+	j.file = nil
+	j.gz = nil
+}
+
+// removeExpired deletes the files of the journal that are older than the retention.
+func (j *Journal) removeExpired(now time.Time) {
+	entries, err := os.ReadDir(j.Config.Directory)
+	if err != nil {
+		log.Warn().Err(err).Str("directory", j.Config.Directory).Msg("Unable to list journal files")
+		return
+	}
+
+	cutoff := now.Add(-time.Duration(j.Config.Retention * float64(time.Hour)))
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "journal-") || len(e.Name()) < len(journalFileFormat) {
+			continue
+		}
+
+		hour, err := time.Parse(journalFileFormat, e.Name()[:len(journalFileFormat)])
+		if err != nil || !hour.Before(cutoff) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(j.Config.Directory, e.Name()))
+		if err != nil {
+			log.Warn().Err(err).Str("file", e.Name()).Msg("Unable to remove expired journal file")
+			continue
+		}
+
+		log.Debug().Str("file", e.Name()).Msg("Removed expired journal file")
+	}
+}
@@ -0,0 +1,126 @@
+package zammadbridge
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CallLeg is one participant of a call as reported by 3CX, e.g. the queue, or one of the agents of a conference.
+type CallLeg struct {
+	LegID       json.Number `json:"leg_id"`
+	AgentNumber string      `json:"agent_number"`
+	AgentName   string      `json:"agent_name"`
+	Status      string      `json:"status"`
+}
+
+// legKey identifies the leg within its call. 3CX before v20 does not report legs, so the agent is used instead.
+func legKey(call *CallInformation) string {
+	if call.LegID != "" {
+		return call.LegID.String()
+	}
+
+	return call.AgentNumber
+}
+
+// legRank orders the legs of a call by how well they represent the call as a whole: an agent that is talking
+// beats one that holds the call, which beats a queue or voicemail that is "Talking", which beats ringing agents.
+func (z *ZammadBridge) legRank(call *CallInformation) int {
+	switch z.observedState(call) {
+	case CallStateAnswered:
+		return 3
+	case CallStateHeld:
+		return 2
+	}
+
+	if strings.EqualFold(call.Status, "talking") {
+		return 1
+	}
+
+	return 0
+}
+
+// primaryLeg picks the leg that the call is reported for. The current agent keeps the call as long as its leg ranks
+// highest, such that the call does not flicker between the agents of a conference, or agents that ring at once.
+func (z *ZammadBridge) primaryLeg(legs []CallInformation, currentAgent string) CallInformation {
+	best := 0
+	for i := 1; i < len(legs); i++ {
+		if z.preferLeg(&legs[i], &legs[best], currentAgent) {
+			best = i
+		}
+	}
+
+	return legs[best]
+}
+
+// preferLeg checks whether leg a should represent the call rather than leg b.
+func (z *ZammadBridge) preferLeg(a, b *CallInformation, currentAgent string) bool {
+	rankA, rankB := z.legRank(a), z.legRank(b)
+	if rankA != rankB {
+		return rankA > rankB
+	}
+
+	if (a.AgentNumber == currentAgent) != (b.AgentNumber == currentAgent) {
+		return a.AgentNumber == currentAgent
+	}
+
+	// Otherwise the oldest leg wins, as far as 3CX tells
+	legA, errA := a.LegID.Int64()
+	legB, errB := b.LegID.Int64()
+	return errA == nil && errB == nil && legA < legB
+}
+
+// trackLegs records the current legs of the call, and the agents that join it as a conference.
+func (z *ZammadBridge) trackLegs(l *callLifecycle, legs []CallInformation) {
+	current := make(map[string]CallLeg, len(legs))
+	for i := range legs {
+		leg := &legs[i]
+		current[legKey(leg)] = CallLeg{
+			LegID:       leg.LegID,
+			AgentNumber: leg.AgentNumber,
+			AgentName:   leg.AgentName,
+			Status:      leg.Status,
+		}
+
+		if leg.AgentNumber == l.Call.AgentNumber || z.observedState(leg) != CallStateAnswered {
+			continue
+		}
+
+		if !slices.Contains(l.Conference, leg.AgentNumber) {
+			l.Conference = append(l.Conference, leg.AgentNumber)
+			l.changed = true
+			log.Info().Str("call_id", l.Call.CallUID).Str("agent", leg.AgentNumber).Str("reported_agent", l.Call.AgentNumber).Msg("Agent joined the call")
+		}
+	}
+
+	// A leg that stops ringing while the call goes on was rejected, or gave up ringing
+	if !l.hasBeen(CallStateAnswered) {
+		for key, leg := range l.Legs {
+			if _, ok := current[key]; ok || !z.isRingingAgentLeg(leg) || slices.Contains(l.Rejected, leg.AgentNumber) {
+				continue
+			}
+
+			l.Rejected = append(l.Rejected, leg.AgentNumber)
+			l.changed = true
+			log.Debug().Str("call_id", l.Call.CallUID).Str("agent", leg.AgentNumber).Msg("Agent stopped ringing")
+		}
+	}
+
+	if !maps.Equal(current, l.Legs) {
+		l.Legs = current
+		l.changed = true
+	}
+}
+
+// isRingingAgentLeg checks whether the leg was ringing at an agent, rather than at the queue or the voicemail.
+func (z *ZammadBridge) isRingingAgentLeg(leg CallLeg) bool {
+	if leg.AgentNumber == "" || leg.AgentNumber == strconv.Itoa(z.Config.Phone3CX.QueueExtension) || slices.Contains(z.Config.Phone3CX.VoicemailExtensions, leg.AgentNumber) {
+		return false
+	}
+
+	return z.observedState(&CallInformation{Status: leg.Status}) == CallStateRinging
+}
@@ -0,0 +1,109 @@
+package zammadbridge
+
+import (
+	"strings"
+)
+
+// CallOutcome describes how a call ended. It is derived from what the bridge observed during the call, because 3CX
+// does not report why a call ended.
+type CallOutcome string
+
+const (
+	// CallOutcomeAnswered is a call that was answered and then ended normally.
+	CallOutcomeAnswered CallOutcome = "answered"
+	// CallOutcomeEndedRinging is a call that ended while it was still ringing.
+	CallOutcomeEndedRinging CallOutcome = "ended_ringing"
+	// CallOutcomeRejected is a call whose agent stopped ringing, e.g. because it was rejected, while the caller
+	// was still waiting.
+	CallOutcomeRejected CallOutcome = "rejected"
+	// CallOutcomeForwarded is a call that rang at another agent before anyone answered.
+	CallOutcomeForwarded CallOutcome = "forwarded"
+	// CallOutcomeQueueAbandoned is a call that ended while it was waiting in the queue.
+	CallOutcomeQueueAbandoned CallOutcome = "queue_abandoned"
+	// CallOutcomeVoicemail is a call that was answered by the voicemail.
+	CallOutcomeVoicemail CallOutcome = "voicemail"
+	// CallOutcomeInterrupted is a call that ended while the bridge was not running, so how it ended is unknown.
+	CallOutcomeInterrupted CallOutcome = "interrupted"
+)
+
+// DefaultHangupCauses maps every outcome to the cause that is reported to Zammad, unless configured otherwise.
+var DefaultHangupCauses = map[CallOutcome]string{
+	CallOutcomeAnswered:       "normalClearing",
+	CallOutcomeEndedRinging:   "cancel",
+	CallOutcomeRejected:       "busy",
+	CallOutcomeForwarded:      "forwarded",
+	CallOutcomeQueueAbandoned: "cancel",
+	CallOutcomeVoicemail:      "noAnswer",
+	CallOutcomeInterrupted:    "normalClearing",
+}
+
+// outcome derives how the call ended from everything that was observed during its lifecycle.
+func (l *callLifecycle) outcome() CallOutcome {
+	if l.hasBeen(CallStateAnswered) {
+		return CallOutcomeAnswered
+	}
+
+	if l.Voicemail {
+		return CallOutcomeVoicemail
+	}
+
+	// The agents of a queue ring and stop ringing as the queue sees fit
+	if l.InQueue {
+		return CallOutcomeQueueAbandoned
+	}
+
+	if len(l.Agents) > 1 {
+		return CallOutcomeForwarded
+	}
+
+	if len(l.Rejected) > 0 {
+		return CallOutcomeRejected
+	}
+
+	return CallOutcomeEndedRinging
+}
+
+// observe records the agent of the call, such that the outcome can be derived later on.
+func (z *ZammadBridge) observe(l *callLifecycle) {
+	call := &l.Call
+
+	if z.isCallToQueue(*call) {
+		l.changed = l.changed || !l.InQueue
+		l.InQueue = true
+	} else if z.isVoicemail(call) {
+		l.changed = l.changed || !l.Voicemail
+		l.Voicemail = true
+	} else if len(l.Agents) == 0 || l.Agents[len(l.Agents)-1] != call.AgentNumber {
+		l.Agents = append(l.Agents, call.AgentNumber)
+		l.changed = true
+	}
+}
+
+// DefaultVoicemailDNTypes are the v20 DN types of voicemail and digital receptionists, unless configured otherwise.
+var DefaultVoicemailDNTypes = []string{"Wivr", "Wspecialmenu"}
+
+// isVoicemail checks whether the call is connected to a voicemail box or a digital receptionist instead of an agent.
+func (z *ZammadBridge) isVoicemail(call *CallInformation) bool {
+	for _, extension := range z.Config.Phone3CX.VoicemailExtensions {
+		if call.CalleeNumber == extension {
+			return true
+		}
+	}
+
+	if call.CalleeType == "" {
+		return false
+	}
+
+	dnTypes := z.Config.Phone3CX.VoicemailDNTypes
+	if dnTypes == nil {
+		dnTypes = DefaultVoicemailDNTypes
+	}
+
+	for _, dnType := range dnTypes {
+		if strings.EqualFold(call.CalleeType, dnType) {
+			return true
+		}
+	}
+
+	return false
+}
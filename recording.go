@@ -0,0 +1,209 @@
+package zammadbridge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RecordingConfig configures attaching 3CX call recordings to Zammad tickets.
+type RecordingConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Mode is either "attach" to upload the audio file, or "link" to only post a link to it.
+	Mode string `yaml:"mode"`
+
+	// LinkURL is the address of the bridge API as Zammad agents reach it, e.g. "https://bridge.example.com:8080".
+	// Links to recordings point to the bridge, which downloads them from 3CX, because 3CX only serves them to API
+	// clients. The links are signed with Bridge.api_secret. Without LinkURL, recordings can only be attached.
+	LinkURL string `yaml:"link_url"`
+
+	// MaxSize is the largest recording (in bytes) that is attached. Larger recordings are linked instead.
+	MaxSize int64 `yaml:"max_size"`
+
+	// Delay is the number of seconds to wait after a call ended before looking for its recording (default 30). It
+	// doubles for every retry. MaxRetries defaults to 5 when not set, and 0 disables retries.
+	Delay      *float64 `yaml:"delay"`
+	MaxRetries *int     `yaml:"max_retries"`
+}
+
+var (
+	errRecordingNotFound = errors.New("recording not found")
+	errRecordingTooLarge = errors.New("recording is too large")
+	errTicketNotFound    = errors.New("no ticket found for the caller")
+)
+
+// RecordingSink attaches the recording of every answered call as an internal note to the latest ticket of the
+// caller in Zammad. It works in the background, because 3CX only offers the recording a while after the call.
+type RecordingSink struct {
+	Config RecordingConfig
+
+	client3CX  API3CX
+	zammad     *ZammadClient
+	delay      time.Duration
+	maxRetries int
+}
+
+// NewRecordingSink creates a sink that attaches recordings, applying the defaults of the configuration.
+func NewRecordingSink(config RecordingConfig, client3CX API3CX, zammad *ZammadClient) *RecordingSink {
+	if config.Mode == "" {
+		config.Mode = "attach"
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = 20 << 20
+	}
+
+	r := &RecordingSink{
+		Config:     config,
+		client3CX:  client3CX,
+		zammad:     zammad,
+		delay:      30 * time.Second,
+		maxRetries: 5,
+	}
+	if config.Delay != nil {
+		r.delay = time.Duration(float64(time.Second) * *config.Delay)
+	}
+	if config.MaxRetries != nil {
+		r.maxRetries = *config.MaxRetries
+	}
+
+	return r
+}
+
+func (r *RecordingSink) Name() string {
+	return "recordings"
+}
+
+// async marks the recordings as attached in the background, see asyncSink.
+func (r *RecordingSink) async() {}
+
+func (r *RecordingSink) NewCall(_ *CallInformation) error {
+	return nil
+}
+
+func (r *RecordingSink) Answer(_ *CallInformation) error {
+	return nil
+}
+
+func (r *RecordingSink) Transfer(_ *CallInformation) error {
+	return nil
+}
+
+// Hangup starts looking for the recording of answered calls in the background.
+func (r *RecordingSink) Hangup(call *CallInformation, outcome CallOutcome) error {
+	if outcome != CallOutcomeAnswered {
+		return nil
+	}
+
+	go r.attachRetry(*call)
+	return nil
+}
+
+// attachRetry waits for the recording to become available and attaches it, retrying with an exponential backoff.
+func (r *RecordingSink) attachRetry(call CallInformation) {
+	delay := r.delay
+
+	var err error
+	for attempt := 0; attempt <= r.maxRetries; attempt++ {
+		time.Sleep(delay)
+		delay = min(delay*2, 10*time.Minute)
+
+		err = r.attach(call)
+		if err == nil {
+			return
+		}
+
+		if errors.Is(err, ErrNotSupported) {
+			log.Warn().Err(err).Msg("Unable to attach call recordings")
+			return
+		}
+
+		log.Debug().Err(err).Str("call_id", call.CallUID).Int("attempt", attempt+1).Msg("Unable to attach recording yet")
+	}
+
+	log.Error().Err(err).Str("call_id", call.CallUID).Str("from", call.CallFrom).Str("to", call.CallTo).Msg("Giving up on attaching recording")
+}
+
+// attach looks up the recording and the ticket, and posts the internal note.
+func (r *RecordingSink) attach(call CallInformation) error {
+	recording, err := r.client3CX.FindRecording(call)
+	if err != nil {
+		return err
+	}
+	if recording == nil {
+		return errRecordingNotFound
+	}
+
+	if r.zammad.dryRun != nil {
+		log.Info().Str("call_id", call.CallUID).Int("recording", recording.ID).Msg("Dry-run mode: not attaching recording")
+		return nil
+	}
+
+	ticketID, err := r.zammad.findTicketForCaller(call.ExternalNumber)
+	if err != nil {
+		return err
+	}
+
+	var attachment *zammadAttachment
+	if r.Config.Mode == "attach" {
+		data, err := r.client3CX.DownloadRecording(recording, r.Config.MaxSize)
+		if errors.Is(err, errRecordingTooLarge) {
+			log.Info().Str("call_id", call.CallUID).Int64("max_size", r.Config.MaxSize).Msg("Recording is too large to attach - linking it instead")
+		} else if err != nil {
+			return fmt.Errorf("unable to download recording: %w", err)
+		} else {
+			attachment = &zammadAttachment{
+				Filename: fmt.Sprintf("recording-%s-%s.wav", call.ExternalNumber, recording.StartTime.Format("20060102-150405")),
+				Data:     base64.StdEncoding.EncodeToString(data),
+				MimeType: http.DetectContentType(data),
+			}
+		}
+	}
+
+	body := fmt.Sprintf(
+		"Recording of the %s call from %s to %s on %s (%s).",
+		html.EscapeString(call.Direction),
+		html.EscapeString(call.CallFrom),
+		html.EscapeString(call.CallTo),
+		recording.StartTime.Local().Format(time.DateTime),
+		recording.EndTime.Sub(recording.StartTime).Round(time.Second),
+	)
+	if attachment == nil && r.Config.LinkURL != "" {
+		link := r.link(recording.ID)
+		body += fmt.Sprintf(` <a href="%s">recording-%d.wav</a>`, html.EscapeString(link), recording.ID)
+	} else if attachment == nil {
+		body += fmt.Sprintf(" The recording is too large to attach, it is available in 3CX (ID %d).", recording.ID)
+	}
+
+	err = r.zammad.addInternalNote(ticketID, "Call recording", body, attachment)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("call_id", call.CallUID).Int("ticket_id", ticketID).Bool("attached", attachment != nil).Msg("Added call recording to ticket")
+	return nil
+}
+
+// link returns the signed address at which the bridge API serves the recording, see ZammadBridge.handleRecording.
+func (r *RecordingSink) link(id int) string {
+	configMu.RLock()
+	secret := r.zammad.Config.Bridge.ApiSecret
+	configMu.RUnlock()
+
+	return fmt.Sprintf("%s/recordings/%d?sig=%s", strings.TrimSuffix(r.Config.LinkURL, "/"), id, recordingSignature(secret, id))
+}
+
+// recordingSignature signs the ID of a recording, such that the bridge API only serves the recordings it linked.
+func recordingSignature(secret string, id int) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "recording/%d", id)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,86 @@
+package zammadbridge
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// redactedPlaceholder replaces secrets in URLs.
+const redactedPlaceholder = "xxxxx"
+
+// RedactURL hides the secrets within an URL, such that it can safely appear in logs and errors. This covers the
+// password of the user info, all query values, and the secret token of the Zammad CTI endpoint (/api/v1/cti/<secret>).
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactedPlaceholder
+	}
+
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedPlaceholder)
+		}
+	}
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		for k := range query {
+			query.Set(k, redactedPlaceholder)
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	segments := strings.Split(u.Path, "/")
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i] == "cti" && segments[i+1] != "" {
+			segments[i+1] = redactedPlaceholder
+		}
+	}
+	u.Path = strings.Join(segments, "/")
+	u.RawPath = ""
+
+	return u.String()
+}
+
+// redactError hides the secrets of the URL that is part of errors returned by the HTTP client.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = RedactURL(urlErr.URL)
+	}
+
+	return err
+}
+
+// Redacted returns a copy of the configuration without its secrets, such that it can be shown.
+func (c *Config) Redacted() Config {
+	redacted := *c
+	for _, secret := range []*string{&redacted.Bridge.ApiSecret, &redacted.Phone3CX.Pass, &redacted.Phone3CX.ClientSecret, &redacted.Zammad.Token, &redacted.Zammad.ApiToken} {
+		if *secret != "" {
+			*secret = redactedPlaceholder
+		}
+	}
+
+	redacted.Zammad.Endpoint = RedactURL(c.Zammad.Endpoint)
+	redacted.Zammad.ApiURL = RedactURL(c.Zammad.ApiURL)
+	redacted.Phone3CX.Transport.Proxy = RedactURL(c.Phone3CX.Transport.Proxy)
+	redacted.Zammad.Transport.Proxy = RedactURL(c.Zammad.Transport.Proxy)
+
+	redacted.Webhooks = make([]WebhookConfig, len(c.Webhooks))
+	for i, w := range c.Webhooks {
+		w.URL = RedactURL(w.URL)
+		w.Transport.Proxy = RedactURL(w.Transport.Proxy)
+
+		// The headers usually authenticate the requests
+		headers := make(map[string]string, len(w.Headers))
+		for k := range w.Headers {
+			headers[k] = redactedPlaceholder
+		}
+		w.Headers = headers
+
+		redacted.Webhooks[i] = w
+	}
+
+	return redacted
+}
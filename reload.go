@@ -0,0 +1,254 @@
+package zammadbridge
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// restartSettings are the settings that are only used when the bridge starts, such as the files it opens and the
+// HTTP clients it creates. A reload keeps their previous value.
+var restartSettings = map[string]bool{
+	"Bridge.state_file":     true,
+	"Bridge.history_file":   true,
+	"Bridge.api_listen":     true,
+	"3CX.host":              true,
+	"3CX.transport":         true,
+	"Zammad.dry_run":        true,
+	"Zammad.dry_run_output": true,
+	"Zammad.transport":      true,
+	"Journal":               true,
+}
+
+// credentials3CX are the settings that the bridge authenticates to 3CX with.
+var credentials3CX = []string{"3CX.user", "3CX.pass", "3CX.client_id", "3CX.client_secret"}
+
+// configSource is a file (or the directory of drop-in files) that the configuration was read from, and the version
+// of it that was read.
+type configSource struct {
+	path    string
+	dir     bool
+	modTime time.Time
+	size    int64
+}
+
+func newConfigSource(path string) (*configSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &configSource{path: path, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// changed checks whether the file changed since it was last checked, such that every change is reported once.
+func (s *configSource) changed() bool {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		// The file was removed, which is only a change the first time
+		removed := s.size < 0
+		s.size = -1
+		return !removed
+	}
+
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return false
+	}
+
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return true
+}
+
+// reloadRequested checks whether the configuration should be reloaded, because of a SIGHUP or because one of its
+// files changed. It returns the reason.
+func (z *ZammadBridge) reloadRequested(hup <-chan os.Signal) (string, bool) {
+	select {
+	case <-hup:
+		return "SIGHUP", true
+	default:
+	}
+
+	for _, source := range z.Config.sources {
+		if source.changed() {
+			return source.path + " changed", true
+		}
+	}
+
+	return "", false
+}
+
+// reload loads the configuration again and applies it, see applyConfig. An invalid configuration is rejected as a
+// whole, and the bridge continues with the previous one.
+func (z *ZammadBridge) reload(reason string) {
+	log.Info().Str("reason", reason).Msg("Reloading configuration")
+
+	next, err := LoadConfig(z.Config.locations, z.Config.overrides...)
+	if err == nil {
+		// The dry-run mode may also come from the command line
+		next.Zammad.DryRun = next.Zammad.DryRun || z.Config.Zammad.DryRun
+		err = next.Validate()
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to reload configuration - keeping the previous one")
+		return
+	}
+
+	err = z.applyConfig(next)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to apply the reloaded configuration - keeping the previous one")
+	}
+}
+
+// applyConfig changes the configuration of the running bridge to next. The ongoing calls are kept, and settings that
+// are only used on start (see restartSettings) keep their previous value. Webhooks and recordings are only recreated
+// if their configuration changed, see reloadSinks.
+func (z *ZammadBridge) applyConfig(next *Config) error {
+	sinks := z.Sinks
+	if !reflect.DeepEqual(z.Config.Webhooks, next.Webhooks) || !reflect.DeepEqual(z.Config.Recordings, next.Recordings) {
+		var err error
+		sinks, err = z.reloadSinks(next)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The sinks and their configuration are in use while events are delivered
+	z.deliverMu.Lock()
+	z.mu.Lock()
+	configMu.Lock()
+
+	var changed, restart []string
+	applyChanges(reflect.ValueOf(z.Config).Elem(), reflect.ValueOf(next).Elem(), "", &changed, &restart)
+	z.Config.secrets = next.secrets
+	z.Config.sources = next.sources
+
+	configMu.Unlock()
+
+	z.Sinks = sinks
+	if zammad := z.zammadClient(); zammad != nil && (slices.Contains(changed, "Zammad.users") || slices.Contains(changed, "Zammad.user_lookup_attribute")) {
+		zammad.users = map[string]cachedZammadUser{}
+	}
+
+	z.mu.Unlock()
+	z.deliverMu.Unlock()
+
+	if len(restart) > 0 {
+		log.Warn().Strs("settings", restart).Msg("Some changed settings only take effect after a restart")
+	}
+
+	if len(changed) == 0 {
+		log.Info().Msg("The configuration is unchanged")
+		return nil
+	}
+
+	log.Info().Strs("settings", changed).Msg("Reloaded configuration")
+
+	for _, name := range credentials3CX {
+		if slices.Contains(changed, name) {
+			err := z.Client3CX.AuthenticateRetry(time.Second * 120)
+			if err != nil {
+				log.Error().Err(err).Msg("Unable to authenticate to 3CX with the reloaded credentials")
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// reloadSinks creates the sinks for the next configuration. Webhooks whose configuration did not change are kept, such
+// that the events they still have queued are delivered in order before any later event of the same call. The events
+// that are still queued for the webhooks that changed are delivered regardless.
+func (z *ZammadBridge) reloadSinks(next *Config) ([]CallEventSink, error) {
+	var webhooks []*WebhookSink
+	var recordings *RecordingSink
+	for _, sink := range z.Sinks {
+		switch s := sink.(type) {
+		case *WebhookSink:
+			webhooks = append(webhooks, s)
+		case *RecordingSink:
+			recordings = s
+		}
+	}
+
+	sinks := []CallEventSink{z.zammadClient()}
+	for _, config := range next.Webhooks {
+		var webhook *WebhookSink
+		for i, previous := range webhooks {
+			if previous != nil && i < len(z.Config.Webhooks) && reflect.DeepEqual(z.Config.Webhooks[i], config) {
+				webhook, webhooks[i] = previous, nil
+				break
+			}
+		}
+
+		if webhook == nil {
+			var err error
+			webhook, err = NewWebhookSink(config)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create webhook: %w", err)
+			}
+		}
+		sinks = append(sinks, webhook)
+	}
+
+	if next.Recordings.Enabled {
+		if recordings == nil || !reflect.DeepEqual(z.Config.Recordings, next.Recordings) {
+			recordings = NewRecordingSink(next.Recordings, z.Client3CX, z.zammadClient())
+		}
+		sinks = append(sinks, recordings)
+	}
+
+	return sinks, nil
+}
+
+// applyChanges copies the settings of the struct next that differ into the struct c, except for restartSettings.
+// The names of the settings (e.g. "Bridge.poll_interval") are collected in changed and restart. Only the settings
+// that differ are written, because other goroutines may read them.
+func applyChanges(c reflect.Value, next reflect.Value, prefix string, changed *[]string, restart *[]string) {
+	t := c.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name := tag
+		if prefix != "" {
+			name = prefix + "." + tag
+		}
+
+		if reflect.DeepEqual(c.Field(i).Interface(), next.Field(i).Interface()) {
+			continue
+		}
+
+		if restartSettings[name] {
+			*restart = append(*restart, name)
+			continue
+		}
+
+		if c.Field(i).Kind() == reflect.Struct {
+			applyChanges(c.Field(i), next.Field(i), name, changed, restart)
+			continue
+		}
+
+		c.Field(i).Set(next.Field(i))
+		*changed = append(*changed, name)
+	}
+}
+
+// zammadClient returns the sink that notifies Zammad.
+func (z *ZammadBridge) zammadClient() *ZammadClient {
+	for _, sink := range z.Sinks {
+		if zammad, ok := sink.(*ZammadClient); ok {
+			return zammad
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package zammadbridge
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ReadJournal reads the entries of a journal file, which may be gzipped. A file that ends abruptly, e.g. because the
+// bridge is still writing it, is read up to that point. Entries that are marked Same get the data of the previous
+// entry of their kind.
+func ReadJournal(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open journal: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var r io.Reader = reader
+	if magic, _ := reader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gzipped journal: %w", err)
+		}
+		r = gz
+	}
+
+	var entries []JournalEntry
+	previous := map[string]json.RawMessage{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry JournalEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse journal line %d: %w", line, err)
+		}
+
+		if entry.Same {
+			entry.Data = previous[entry.Kind]
+		} else if entry.Data != nil {
+			previous[entry.Kind] = entry.Data
+		}
+
+		entries = append(entries, entry)
+	}
+
+	err = scanner.Err()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Warn().Str("file", path).Int("entries", len(entries)).Msg("Journal ends abruptly - replaying what was written")
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read journal: %w", err)
+	}
+
+	return entries, nil
+}
+
+// replayClient plays back the recorded responses of 3CX, one per poll.
+type replayClient struct {
+	API3CX
+
+	config *Config
+	calls  []CallInformation
+	err    error
+}
+
+func (r *replayClient) FetchCalls() ([]CallInformation, error) {
+	return r.calls, r.err
+}
+
+// IsExtension cannot ask 3CX, so every number with the configured number of digits is an extension.
+func (r *replayClient) IsExtension(number string) bool {
+	return len(number) == r.config.Phone3CX.ExtensionDigits
+}
+
+// load prepares the calls of a recorded response.
+func (r *replayClient) load(entry JournalEntry) {
+	r.calls, r.err = nil, nil
+	if entry.Error != "" {
+		r.err = errors.New(entry.Error)
+		return
+	}
+
+	if entry.Kind == JournalKindActiveCalls {
+		r.calls, r.err = parseActiveCalls(entry.Data)
+	} else {
+		r.calls, r.err = (&Client3CXPost20{Config: r.config}).parseCallControl(entry.Data)
+	}
+
+	if r.err != nil {
+		log.Warn().Err(r.err).Time("time", entry.Time).Msg("Unable to parse recorded response")
+	}
+
+	setPolledAt(r.calls, entry.Time)
+}
+
+// replayRecorder collects the dry-run records of the Zammad client.
+type replayRecorder struct {
+	output   io.Writer
+	payloads []json.RawMessage
+}
+
+func (r *replayRecorder) Write(line []byte) (int, error) {
+	var record zammadDryRunRecord
+	err := json.Unmarshal(line, &record)
+	if err != nil {
+		return 0, err
+	}
+	r.payloads = append(r.payloads, record.Payload)
+
+	if r.output != nil {
+		return r.output.Write(line)
+	}
+
+	return len(line), nil
+}
+
+// RecordedPayloads returns the payloads that were sent to Zammad successfully according to the journal, which is
+// what Replay returns for an unchanged bridge.
+func RecordedPayloads(entries []JournalEntry) []json.RawMessage {
+	var payloads []json.RawMessage
+	for _, e := range entries {
+		if e.Kind == JournalKindZammad && e.Error == "" {
+			payloads = append(payloads, e.Data)
+		}
+	}
+
+	return payloads
+}
+
+// Replay feeds the responses of 3CX recorded in the journal into the bridge logic, and returns the payloads that
+// would have been sent to Zammad. They are also written to output as dry-run records, if not nil. The clock of the
+// bridge follows the time of the recording, and speed sets how fast the recording is played: 1 is the original
+// timing, 2 twice as fast and 0 as fast as possible.
+//
+// Nothing is sent or stored, and Zammad users are only mapped statically. Websocket frames are not replayed, because
+// the bridge does not process them either: calls are only taken from the polled responses. A journal of only
+// websocket frames is rejected.
+func Replay(config Config, entries []JournalEntry, speed float64, output io.Writer) ([]json.RawMessage, error) {
+	config.Zammad.UserLookupAttribute = ""
+
+	var clock time.Time
+	now := func() time.Time { return clock }
+
+	recorder := &replayRecorder{output: output}
+	zammad := &ZammadClient{
+		Config: &config,
+		dryRun: recorder,
+		users:  map[string]cachedZammadUser{},
+		now:    now,
+	}
+
+	client := &replayClient{config: &config}
+	z := &ZammadBridge{
+		Config:       &config,
+		Client3CX:    client,
+		Sinks:        []CallEventSink{zammad},
+		ongoingCalls: map[json.Number]*callLifecycle{},
+		now:          now,
+	}
+
+	var polls, frames int
+	for _, entry := range entries {
+		if entry.Kind == JournalKindWebsocket {
+			frames++
+			continue
+		}
+		if entry.Kind != JournalKindActiveCalls && entry.Kind != JournalKindCallControl {
+			continue
+		}
+
+		if speed > 0 && !clock.IsZero() {
+			time.Sleep(time.Duration(float64(entry.Time.Sub(clock)) / speed))
+		}
+		clock = entry.Time
+		polls++
+
+		client.load(entry)
+		err := z.RequestAndProcess()
+		if err != nil {
+			log.Debug().Err(err).Time("time", entry.Time).Msg("Recorded poll failed")
+		}
+	}
+
+	if polls == 0 && frames > 0 {
+		return nil, fmt.Errorf("the journal only contains %d websocket frames, which cannot be replayed - only the polled 3CX responses can", frames)
+	}
+	if polls == 0 {
+		return nil, fmt.Errorf("the journal contains no 3CX responses")
+	}
+
+	if frames > 0 {
+		log.Warn().Int("frames", frames).Msg("Skipped the websocket frames of the journal - only the polled 3CX responses are replayed")
+	}
+
+	log.Info().Int("polls", polls).Int("ongoing_calls", len(z.Calls())).Int("payloads", len(recorder.payloads)).Msg("Replay finished")
+	return recorder.payloads, nil
+}
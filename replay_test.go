@@ -0,0 +1,97 @@
+package zammadbridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestReplayUnchanged records a journal of a live v20 bridge and replays it, which must send the same payloads, i.e.
+// "replay --diff" shows no differences.
+func TestReplayUnchanged(t *testing.T) {
+	var mu sync.Mutex
+	var callControl string
+	pbx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = w.Write([]byte(callControl))
+	}))
+	defer pbx.Close()
+
+	zammadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer zammadServer.Close()
+
+	config := &Config{}
+	config.Phone3CX.Host = pbx.URL
+	config.Phone3CX.ExtensionDigits = 3
+	config.Phone3CX.TrunkDigits = 5
+	config.Zammad.Endpoint = zammadServer.URL
+
+	journal, err := NewJournal(JournalConfig{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zammad := &ZammadClient{Config: config, users: map[string]cachedZammadUser{}, journal: journal}
+	z := &ZammadBridge{
+		Config:       config,
+		Client3CX:    &Client3CXPost20{Config: config, journal: journal},
+		Sinks:        []CallEventSink{zammad},
+		ongoingCalls: map[json.Number]*callLifecycle{},
+	}
+
+	ringing := `{"id":1,"status":"Ringing","dn":"150","party_dn":"10007","party_caller_id":"0123456789","callid":7,"legid":1}`
+	connected := `{"id":1,"status":"Connected","dn":"150","party_dn":"10007","party_caller_id":"0123456789","callid":7,"legid":1}`
+	missed := `{"id":2,"status":"Ringing","dn":"151","party_dn":"10008","party_caller_id":"0987654321","callid":8,"legid":1}`
+	polls := []string{
+		`[{"dn":"150","type":"Wextension","participants":[` + ringing + `]},{"dn":"151","type":"Wextension","participants":[` + missed + `]}]`,
+		`[{"dn":"150","type":"Wextension","participants":[` + connected + `]},{"dn":"151","type":"Wextension","participants":[` + missed + `]}]`,
+		`[{"dn":"150","type":"Wextension","participants":[` + connected + `]}]`,
+		`[]`,
+		`[]`,
+		`[]`,
+	}
+
+	for _, poll := range polls {
+		mu.Lock()
+		callControl = poll
+		mu.Unlock()
+
+		err := z.RequestAndProcess()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	journal.mu.Lock()
+	journal.close()
+	journal.mu.Unlock()
+
+	files, _ := filepath.Glob(filepath.Join(journal.Config.Directory, "*.jsonl.gz"))
+	var entries []JournalEntry
+	for _, file := range files {
+		e, err := ReadJournal(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e...)
+	}
+
+	recorded := RecordedPayloads(entries)
+	if len(recorded) != 5 {
+		t.Fatalf("expected 5 recorded payloads, got %d", len(recorded))
+	}
+
+	replayed, err := Replay(*config, entries, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(recorded, replayed) {
+		t.Errorf("the replay differs from the recording\nrecorded: %s\nreplayed: %s", recorded, replayed)
+	}
+}
@@ -0,0 +1,163 @@
+package zammadbridge
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// configMu guards the fields of a Config that change while the bridge runs, such as rotated secrets. They are only
+// changed on the goroutine of Listen, so other goroutines (e.g. the bridge API) read them under configMu.
+var configMu sync.RWMutex
+
+// secretField is a secret of the configuration that can be read from a file. The file is either configured, or
+// it is the systemd credential of the same name in $CREDENTIALS_DIRECTORY.
+type secretField struct {
+	credential string
+	file       func(c *Config) string
+	value      func(c *Config) *string
+}
+
+var secretFields = []secretField{
+	{"bridge_api_secret", func(c *Config) string { return c.Bridge.ApiSecretFile }, func(c *Config) *string { return &c.Bridge.ApiSecret }},
+	{"3cx_pass", func(c *Config) string { return c.Phone3CX.PassFile }, func(c *Config) *string { return &c.Phone3CX.Pass }},
+	{"3cx_client_secret", func(c *Config) string { return c.Phone3CX.ClientSecretFile }, func(c *Config) *string { return &c.Phone3CX.ClientSecret }},
+	{"zammad_endpoint", func(c *Config) string { return c.Zammad.EndpointFile }, func(c *Config) *string { return &c.Zammad.Endpoint }},
+	{"zammad_token", func(c *Config) string { return c.Zammad.TokenFile }, func(c *Config) *string { return &c.Zammad.Token }},
+	{"zammad_api_token", func(c *Config) string { return c.Zammad.ApiTokenFile }, func(c *Config) *string { return &c.Zammad.ApiToken }},
+}
+
+// secretSource is a file that a secret was read from, and the version of the file that was read.
+type secretSource struct {
+	field   secretField
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// LoadSecrets reads the secrets that are configured as files (e.g. client_secret_file), or given as systemd
+// credentials (e.g. LoadCredential=3cx_client_secret:/path). Relative paths are looked up in $CREDENTIALS_DIRECTORY
+// first. A secret from a file replaces the value in the configuration.
+func (c *Config) LoadSecrets() error {
+	credentials := os.Getenv("CREDENTIALS_DIRECTORY")
+
+	c.secrets = nil
+	for _, field := range secretFields {
+		path := field.file(c)
+		if path == "" && credentials != "" {
+			path = filepath.Join(credentials, field.credential)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+		} else if path == "" {
+			continue
+		} else if !filepath.IsAbs(path) && credentials != "" {
+			if _, err := os.Stat(filepath.Join(credentials, path)); err == nil {
+				path = filepath.Join(credentials, path)
+			}
+		}
+
+		source := &secretSource{field: field, path: path}
+		_, err := source.read(c)
+		if err != nil {
+			return err
+		}
+
+		log.Debug().Str("secret", field.credential).Str("file", path).Msg("Loaded secret from file")
+		c.secrets = append(c.secrets, source)
+	}
+
+	return nil
+}
+
+// RefreshSecrets reads the secret files again that changed since they were read, e.g. because the credential was
+// rotated. It returns the names of the secrets whose value changed, such as "3cx_client_secret".
+func (c *Config) RefreshSecrets() ([]string, error) {
+	var changed []string
+	var errs []error
+	for _, source := range c.secrets {
+		info, err := os.Stat(source.path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to check secret file %s: %w", source.path, err))
+			continue
+		}
+
+		if info.ModTime().Equal(source.modTime) && info.Size() == source.size {
+			continue
+		}
+
+		updated, err := source.read(c)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if updated {
+			changed = append(changed, source.field.credential)
+		}
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+// read sets the secret from the file, and reports whether its value changed.
+func (s *secretSource) read(c *Config) (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, fmt.Errorf("unable to read secret %s: %w", s.field.credential, err)
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, fmt.Errorf("unable to read secret %s: %w", s.field.credential, err)
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return false, fmt.Errorf("secret file %s of %s is empty", s.path, s.field.credential)
+	}
+
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+
+	target := s.field.value(c)
+	if *target == value {
+		return false, nil
+	}
+
+	configMu.Lock()
+	*target = value
+	configMu.Unlock()
+
+	return true, nil
+}
+
+// refreshSecrets picks up rotated secrets, and authenticates to 3CX again if its credentials changed.
+func (z *ZammadBridge) refreshSecrets() {
+	changed, err := z.Config.RefreshSecrets()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to refresh secrets")
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+
+	log.Info().Strs("secrets", changed).Msg("Secrets were rotated")
+
+	for _, name := range changed {
+		if strings.HasPrefix(name, "3cx_") {
+			err = z.Client3CX.AuthenticateRetry(time.Second * 120)
+			if err != nil {
+				log.Error().Err(err).Msg("Unable to authenticate to 3CX with the rotated credentials")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package zammadbridge
+
+// CallEventSink receives the lifecycle events of the calls the bridge monitors. Zammad is one
+// implementation, but the bridge can notify several sinks at once.
+type CallEventSink interface {
+	// Name identifies the sink in logs.
+	Name() string
+
+	// NewCall is sent once, when the bridge notices a new relevant call.
+	NewCall(call *CallInformation) error
+
+	// Answer is sent when an agent picked up the call.
+	Answer(call *CallInformation) error
+
+	// Transfer is sent when an answered call moved on to another agent.
+	Transfer(call *CallInformation) error
+
+	// Hangup is sent when the call has ended, with the outcome that was derived from the history of the call.
+	// The durations of the call are available through CallInformation.RingDuration and CallInformation.TalkDuration.
+	Hangup(call *CallInformation, outcome CallOutcome) error
+}
+
+// asyncSink is implemented by sinks that deliver the events in the background, such that a nil error only means
+// that the event was queued.
+type asyncSink interface {
+	async()
+}
+
+// callEvent is an event of a call that is waiting to be delivered to the sinks, see deliverEvents.
+type callEvent struct {
+	l       *callLifecycle
+	event   string
+	call    CallInformation
+	outcome CallOutcome
+}
+
+// notifyNewCall queues the newCall event for all sinks. The caller has to hold z.mu.
+func (z *ZammadBridge) notifyNewCall(l *callLifecycle) {
+	z.outbox = append(z.outbox, callEvent{l: l, event: "new-call", call: l.Call})
+}
+
+// notifyAnswer queues the answer event for all sinks. The caller has to hold z.mu.
+func (z *ZammadBridge) notifyAnswer(l *callLifecycle) {
+	z.outbox = append(z.outbox, callEvent{l: l, event: "answer", call: l.Call})
+}
+
+// notifyTransfer queues the transfer event for all sinks. The caller has to hold z.mu.
+func (z *ZammadBridge) notifyTransfer(l *callLifecycle) {
+	z.outbox = append(z.outbox, callEvent{l: l, event: "transfer", call: l.Call})
+}
+
+// notifyHangup queues the hangup event for all sinks, after which the call is recorded in the history. The caller has
+// to hold z.mu.
+func (z *ZammadBridge) notifyHangup(l *callLifecycle, outcome CallOutcome) {
+	z.outbox = append(z.outbox, callEvent{l: l, event: "hangup", call: l.Call, outcome: outcome})
+}
+
+// deliverEvents sends the queued events to the sinks, in the order they were queued. The caller must not hold z.mu,
+// such that the snapshots of the calls stay available while the sinks make their requests. Events that other
+// goroutines queue in the meantime are delivered as well, so the events of a call never overtake each other.
+func (z *ZammadBridge) deliverEvents() {
+	z.deliverMu.Lock()
+	defer z.deliverMu.Unlock()
+
+	for {
+		z.mu.Lock()
+		events := z.outbox
+		z.outbox = nil
+		z.mu.Unlock()
+
+		if len(events) == 0 {
+			return
+		}
+
+		for _, e := range events {
+			z.deliver(e)
+		}
+	}
+}
+
+// deliver sends a single event to all sinks, and keeps the results for the call history. The caller has to hold
+// z.deliverMu.
+func (z *ZammadBridge) deliver(e callEvent) {
+	errs := make([]error, len(z.Sinks))
+	for i, s := range z.Sinks {
+		switch e.event {
+		case "new-call":
+			errs[i] = s.NewCall(&e.call)
+		case "answer":
+			errs[i] = s.Answer(&e.call)
+		case "transfer":
+			errs[i] = s.Transfer(&e.call)
+		case "hangup":
+			errs[i] = s.Hangup(&e.call, e.outcome)
+		}
+	}
+
+	z.mu.Lock()
+	for i, s := range z.Sinks {
+		z.delivered(e.l, s, e.event, errs[i])
+	}
+
+	var record *HistoryRecord
+	if e.event == "hangup" && z.history != nil {
+		record = z.historyRecord(e.l, e.outcome)
+	}
+	z.mu.Unlock()
+
+	if record != nil {
+		z.history.Record(*record)
+	}
+}
+
+// delivered logs a failed delivery, and keeps the result per sink for the call history: "ok", "queued" for sinks that
+// deliver in the background, or the first failure of the sink, such that a later success does not hide it. The
+// caller has to hold z.mu.
+func (z *ZammadBridge) delivered(l *callLifecycle, s CallEventSink, event string, err error) {
+	z.LogIfErr(err, s.Name()+": "+event)
+
+	if l.Deliveries == nil {
+		l.Deliveries = map[string]string{}
+	}
+
+	result := "ok"
+	if _, ok := s.(asyncSink); ok {
+		result = "queued"
+	}
+
+	if err != nil && (l.Deliveries[s.Name()] == "" || l.Deliveries[s.Name()] == result) {
+		l.Deliveries[s.Name()] = event + ": " + err.Error()
+	} else if l.Deliveries[s.Name()] == "" {
+		l.Deliveries[s.Name()] = result
+	}
+}
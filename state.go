@@ -0,0 +1,176 @@
+package zammadbridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// stateFile persists the ongoing calls, such that a restarted bridge can continue them, or close those that ended
+// in the meantime.
+type stateFile struct {
+	path string
+}
+
+// persistedState is the content of the state file.
+type persistedState struct {
+	SavedAt time.Time                      `json:"saved_at"`
+	Calls   map[json.Number]*callLifecycle `json:"calls"`
+}
+
+// load reads the calls from the state file. A missing file is not an error.
+func (s *stateFile) load() (map[json.Number]*callLifecycle, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[json.Number]*callLifecycle{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state file: %w", err)
+	}
+
+	var state persistedState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse state file: %w", err)
+	}
+
+	for _, l := range state.Calls {
+		if l.AnsweredLegs == nil {
+			l.AnsweredLegs = map[string]struct{}{}
+		}
+	}
+
+	return state.Calls, nil
+}
+
+// save atomically replaces the state file with the given calls.
+func (s *stateFile) save(calls map[json.Number]*callLifecycle) error {
+	data, err := json.Marshal(persistedState{
+		SavedAt: time.Now(),
+		Calls:   calls,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to serialize state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write temporary state file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("unable to replace state file: %w", err)
+	}
+
+	return nil
+}
+
+// saveState records the calls that are currently ongoing, if anything changed since the last save. The caller has
+// to hold z.mu.
+func (z *ZammadBridge) saveState() {
+	if z.state == nil {
+		return
+	}
+
+	changed := z.stateChanged
+	ongoing := map[json.Number]*callLifecycle{}
+	for id, l := range z.ongoingCalls {
+		changed = changed || l.changed
+		if !l.HangupSent {
+			ongoing[id] = l
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	err := z.state.save(ongoing)
+	if err != nil {
+		log.Error().Err(err).Str("file", z.state.path).Msg("Unable to save state")
+		return
+	}
+
+	z.stateChanged = false
+	for _, l := range z.ongoingCalls {
+		l.changed = false
+	}
+}
+
+// reconcile loads the calls that were ongoing when the bridge stopped, and compares them with the calls that 3CX
+// currently reports. Calls that are still ongoing are resumed, all others are closed at the sinks with the outcome
+// CallOutcomeInterrupted. It has to run before the first poll.
+func (z *ZammadBridge) reconcile() error {
+	if z.state == nil {
+		return nil
+	}
+
+	calls, err := z.state.load()
+	if err != nil {
+		return err
+	}
+
+	if len(calls) == 0 {
+		return nil
+	}
+
+	live, err := z.Client3CX.FetchCalls()
+	if err != nil {
+		// Without knowing which calls are ongoing, we resume all of them and let the polling sort them out
+		log.Warn().Err(err).Msg("Unable to fetch calls from 3CX for reconciliation - resuming all calls")
+	}
+
+	defer z.deliverEvents()
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	for id, l := range calls {
+		if err != nil || z.isLiveCall(l, live) {
+			log.Info().Str("call_id", l.Call.CallUID).Str("direction", l.Call.Direction).Str("from", l.Call.CallFrom).Str("to", l.Call.CallTo).Msg("Resuming call")
+			z.ongoingCalls[id] = l
+			continue
+		}
+
+		log.Info().Str("call_id", l.Call.CallUID).Str("direction", l.Call.Direction).Str("from", l.Call.CallFrom).Str("to", l.Call.CallTo).Msg("Call ended while the bridge was not running")
+		l.Call.EndedAt = time.Now()
+		l.transition(CallStateEnded, l.Call.EndedAt)
+		z.sendHangup(l, CallOutcomeInterrupted)
+	}
+
+	z.stateChanged = true
+	z.saveState()
+
+	return nil
+}
+
+// isLiveCall checks whether the call of the lifecycle is among the calls 3CX reports, and still the same call.
+func (z *ZammadBridge) isLiveCall(l *callLifecycle, live []CallInformation) bool {
+	for _, c := range live {
+		// Without the start time reported by 3CX (v20), the call can only be recognized by its ID
+		c.FirstSeenAt = l.Call.FirstSeenAt
+		if c.ID == l.Call.ID && z.callUID(&c) == l.Call.CallUID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,148 @@
+package zammadbridge
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// TransportConfig configures the HTTP client that is used to talk to a single target, such as 3CX or Zammad.
+// All durations are in seconds.
+type TransportConfig struct {
+	ConnectTimeout float64 `yaml:"connect_timeout"`
+	RequestTimeout float64 `yaml:"request_timeout"`
+
+	// CAFile is a PEM bundle of certificate authorities that are trusted in addition to the system ones.
+	CAFile string `yaml:"ca_file"`
+
+	// PinnedSHA256 lists base64 encoded SHA-256 hashes of public keys (SPKI) that are accepted for the server
+	// certificate, even when it is self-signed. E.g. generated using:
+	// openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+	PinnedSHA256 []string `yaml:"pinned_sha256"`
+
+	// ClientCert and ClientKey are PEM files used for client-certificate (mTLS) authentication.
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+
+	// Proxy is the URL of an HTTP proxy. When empty, the usual HTTP_PROXY/HTTPS_PROXY variables are used.
+	Proxy string `yaml:"proxy"`
+
+	DisableKeepAlives bool    `yaml:"disable_keep_alives"`
+	MaxIdleConns      int     `yaml:"max_idle_conns"`
+	IdleConnTimeout   float64 `yaml:"idle_conn_timeout"`
+}
+
+// NewHTTPClient creates an HTTP client according to the transport settings. The jar may be nil.
+func (t TransportConfig) NewHTTPClient(jar http.CookieJar) (http.Client, error) {
+	tlsConfig, err := t.tlsConfig()
+	if err != nil {
+		return http.Client{}, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if t.Proxy != "" {
+		proxyURL, err := url.Parse(t.Proxy)
+		if err != nil {
+			return http.Client{}, fmt.Errorf("unable to parse proxy url: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   seconds(t.ConnectTimeout, 10*time.Second),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: seconds(t.ConnectTimeout, 10*time.Second),
+		DisableKeepAlives:   t.DisableKeepAlives,
+		MaxIdleConns:        t.MaxIdleConns,
+		MaxIdleConnsPerHost: t.MaxIdleConns,
+		IdleConnTimeout:     seconds(t.IdleConnTimeout, 90*time.Second),
+		ForceAttemptHTTP2:   true,
+	}
+	if transport.MaxIdleConns == 0 {
+		transport.MaxIdleConns = 10
+		transport.MaxIdleConnsPerHost = 10
+	}
+
+	return http.Client{
+		Transport: transport,
+		Jar:       jar,
+		Timeout:   seconds(t.RequestTimeout, 30*time.Second),
+	}, nil
+}
+
+// tlsConfig builds the TLS settings for custom CAs, pinning and client certificates.
+func (t TransportConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if t.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if t.ClientCert != "" || t.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(t.PinnedSHA256) > 0 {
+		pins := map[string]struct{}{}
+		for _, pin := range t.PinnedSHA256 {
+			pins[strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")] = struct{}{}
+		}
+
+		// The pin replaces the regular verification, which is what allows self-signed certificates
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("server did not present a certificate")
+			}
+
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if _, ok := pins[base64.StdEncoding.EncodeToString(sum[:])]; !ok {
+				return fmt.Errorf("server certificate of %q does not match any pinned public key", cs.ServerName)
+			}
+
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// seconds converts a configured number of seconds into a duration, using the fallback when it is not configured.
+func seconds(value float64, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
+	}
+
+	return time.Duration(float64(time.Second) * value)
+}
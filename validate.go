@@ -0,0 +1,160 @@
+package zammadbridge
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ValidationError lists everything that is wrong with a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// configValidator collects the problems of a configuration.
+type configValidator struct {
+	problems []string
+}
+
+func (v *configValidator) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		v.problems = append(v.problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// url checks that the value is an absolute http(s) URL, if it is required or set.
+func (v *configValidator) url(key string, value string, required bool) {
+	if value == "" {
+		v.check(!required, "%s is required", key)
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		v.problems = append(v.problems, fmt.Sprintf("%s is not a valid URL: %s", key, redactError(err)))
+		return
+	}
+
+	v.check((u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "%s must be an http:// or https:// URL, got %q", key, RedactURL(value))
+}
+
+// file checks that the file exists, if it is set.
+func (v *configValidator) file(key string, path string) {
+	if path == "" {
+		return
+	}
+
+	_, err := os.Stat(path)
+	v.check(err == nil, "%s: %v", key, err)
+}
+
+// oneOf checks that the value is one of the allowed values, if it is set.
+func (v *configValidator) oneOf(key string, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+
+	for _, a := range allowed {
+		if strings.EqualFold(value, a) {
+			return
+		}
+	}
+
+	v.problems = append(v.problems, fmt.Sprintf("%s must be one of %s, got %q", key, strings.Join(allowed, ", "), value))
+}
+
+func (v *configValidator) transport(key string, t TransportConfig) {
+	v.check(t.ConnectTimeout >= 0, "%s.connect_timeout must not be negative", key)
+	v.check(t.RequestTimeout >= 0, "%s.request_timeout must not be negative", key)
+	v.check(t.IdleConnTimeout >= 0, "%s.idle_conn_timeout must not be negative", key)
+	v.check(t.MaxIdleConns >= 0, "%s.max_idle_conns must not be negative", key)
+	v.check((t.ClientCert == "") == (t.ClientKey == ""), "%s.client_cert and %s.client_key must be set together", key, key)
+	v.file(key+".ca_file", t.CAFile)
+	v.file(key+".client_cert", t.ClientCert)
+	v.file(key+".client_key", t.ClientKey)
+	v.url(key+".proxy", t.Proxy, false)
+}
+
+// Validate checks the configuration for missing or invalid values. It returns a *ValidationError that lists all
+// problems at once.
+func (c *Config) Validate() error {
+	v := &configValidator{}
+
+	// Bridge
+	v.check(c.Bridge.PollInterval > 0, "Bridge.poll_interval must be greater than 0 (seconds)")
+	v.check(c.Bridge.EndAfterPolls >= 0, "Bridge.end_after_polls must not be negative")
+	v.check(c.Bridge.EndAfter >= 0, "Bridge.end_after must not be negative")
+	v.check(c.Bridge.ApiListen == "" || c.Bridge.ApiSecret != "", "Bridge.api_secret is required when Bridge.api_listen is set")
+
+	// 3CX: v20 and above authenticate with a client ID and secret, older versions with a user and group
+	v.url("3CX.host", c.Phone3CX.Host, true)
+	if c.Phone3CX.ClientID != "" || c.Phone3CX.ClientSecret != "" {
+		v.check(c.Phone3CX.ClientID != "", "3CX.client_id is required together with 3CX.client_secret (v20 and above)")
+		v.check(c.Phone3CX.ClientSecret != "", "3CX.client_secret is required together with 3CX.client_id (v20 and above)")
+	} else {
+		v.check(c.Phone3CX.User != "" && c.Phone3CX.Pass != "", "3CX.client_id and 3CX.client_secret (v20 and above), or 3CX.user and 3CX.pass (before v20) are required")
+		v.check(c.Phone3CX.User == "" || c.Phone3CX.Group != "", "3CX.group is required with 3CX.user (before v20)")
+	}
+	v.check(c.Phone3CX.ExtensionDigits > 0, "3CX.extension_digits must be greater than 0")
+	v.check(c.Phone3CX.TrunkDigits > 0, "3CX.trunk_digits must be greater than 0")
+	v.check(c.Phone3CX.ExtensionDigits == 0 || c.Phone3CX.ExtensionDigits != c.Phone3CX.TrunkDigits, "3CX.extension_digits and 3CX.trunk_digits must differ, otherwise the direction of calls cannot be told")
+	v.check(c.Phone3CX.QueueExtension > 0, "3CX.queue_extension must be greater than 0")
+	v.check(strings.Trim(c.Phone3CX.CountryPrefix, "0123456789") == "", "3CX.country_prefix must only contain digits, got %q", c.Phone3CX.CountryPrefix)
+	v.transport("3CX.transport", c.Phone3CX.Transport)
+
+	// Zammad
+	v.url("Zammad.endpoint", c.Zammad.Endpoint, true)
+	v.url("Zammad.api_url", c.Zammad.ApiURL, false)
+	v.oneOf("Zammad.token_type", c.Zammad.TokenType, "bearer", "token")
+	v.check(c.Zammad.UserLookupAttribute == "" || c.Zammad.ApiToken != "", "Zammad.api_token is required for Zammad.user_lookup_attribute")
+	for outcome := range c.Zammad.HangupCauses {
+		_, ok := DefaultHangupCauses[CallOutcome(outcome)]
+		v.check(ok, "Zammad.hangup_causes: unknown outcome %q", outcome)
+	}
+	v.transport("Zammad.transport", c.Zammad.Transport)
+
+	// Webhooks
+	names := map[string]int{}
+	for i, w := range c.Webhooks {
+		key := fmt.Sprintf("Webhooks[%d]", i)
+		first, duplicate := names[w.displayName()]
+		v.check(!duplicate, "%s has the same name as Webhooks[%d], which the call history cannot tell apart - set a distinct name", key, first)
+		if !duplicate {
+			names[w.displayName()] = i
+		}
+		v.url(key+".url", w.URL, true)
+		v.oneOf(key+".method", w.Method, "POST", "PUT", "PATCH", "GET")
+		for _, event := range w.Events {
+			v.check(slices.Contains([]string{"newCall", "answer", "transfer", "hangup"}, event), "%s.events: unknown event %q, expected newCall, answer, transfer or hangup", key, event)
+		}
+		v.check(w.MaxRetries == nil || *w.MaxRetries >= 0, "%s.max_retries must not be negative", key)
+		v.check(w.RetryBackoff >= 0, "%s.retry_backoff must not be negative", key)
+		v.transport(key+".transport", w.Transport)
+	}
+
+	// Recordings
+	if c.Recordings.Enabled {
+		v.check(c.Recordings.Mode == "" || c.Recordings.Mode == "attach" || c.Recordings.Mode == "link", "Recordings.mode must be attach or link, got %q", c.Recordings.Mode)
+		v.check(c.Recordings.MaxSize >= 0, "Recordings.max_size must not be negative")
+		v.check(c.Recordings.Delay == nil || *c.Recordings.Delay >= 0, "Recordings.delay must not be negative")
+		v.check(c.Recordings.MaxRetries == nil || *c.Recordings.MaxRetries >= 0, "Recordings.max_retries must not be negative")
+		v.check(c.Zammad.ApiToken != "", "Zammad.api_token is required for Recordings")
+		v.url("Recordings.link_url", c.Recordings.LinkURL, c.Recordings.Mode == "link")
+		v.check(c.Recordings.LinkURL == "" || c.Bridge.ApiListen != "", "Bridge.api_listen is required for Recordings.link_url, which serves the linked recordings")
+	}
+
+	// Journal
+	v.check(c.Journal.Retention >= 0, "Journal.retention must not be negative")
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package zammadbridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// WebhookConfig configures a single outgoing webhook that is notified about calls.
+type WebhookConfig struct {
+	// Name identifies the webhook in logs and the call history. It defaults to the URL, without its secrets.
+	Name    string            `yaml:"name"`
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+
+	// Body is a Go template that is rendered with a WebhookEvent. When empty, the WebhookEvent is sent as JSON.
+	Body string `yaml:"body"`
+
+	// Events limits the events that are sent. Possible values: "newCall", "answer", "transfer", "hangup".
+	// When empty, all events are sent.
+	Events []string `yaml:"events"`
+
+	// MaxRetries defaults to 5 when not set, and 0 disables retries.
+	MaxRetries   *int    `yaml:"max_retries"`
+	RetryBackoff float64 `yaml:"retry_backoff"`
+
+	Transport TransportConfig `yaml:"transport"`
+}
+
+// WebhookEvent is the data that is available in the body template of a webhook.
+type WebhookEvent struct {
+	Event string `json:"event"`
+	// Cause is the outcome of the call for hangup events, e.g. "answered" or "queue_abandoned".
+	Cause       string          `json:"cause,omitempty"`
+	Time        time.Time       `json:"time"`
+	RingSeconds float64         `json:"ring_seconds"`
+	TalkSeconds float64         `json:"talk_seconds"`
+	Call        CallInformation `json:"call"`
+}
+
+// webhookDelivery is a rendered request waiting to be sent.
+type webhookDelivery struct {
+	event string
+	body  []byte
+}
+
+// WebhookSink sends call events to an arbitrary HTTP endpoint. Deliveries are retried with an exponential backoff,
+// and the events of a single call are always delivered in order.
+type WebhookSink struct {
+	Config WebhookConfig
+
+	client     http.Client
+	body       *template.Template
+	events     map[string]struct{}
+	maxRetries int
+
+	mu     sync.Mutex
+	queues map[string][]webhookDelivery
+}
+
+// NewWebhookSink creates a webhook sink and parses its body template.
+func NewWebhookSink(config WebhookConfig) (*WebhookSink, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook is missing an url")
+	}
+	if config.Method == "" {
+		config.Method = http.MethodPost
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = 1
+	}
+
+	client, err := config.Transport.NewHTTPClient(nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create HTTP client: %w", err)
+	}
+
+	w := &WebhookSink{
+		Config:     config,
+		client:     client,
+		maxRetries: 5,
+		queues:     map[string][]webhookDelivery{},
+	}
+	if config.MaxRetries != nil {
+		w.maxRetries = *config.MaxRetries
+	}
+
+	if config.Body != "" {
+		tmpl, err := template.New("body").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).Parse(config.Body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse webhook body template: %w", err)
+		}
+		w.body = tmpl
+	}
+
+	if len(config.Events) > 0 {
+		w.events = map[string]struct{}{}
+		for _, e := range config.Events {
+			w.events[e] = struct{}{}
+		}
+	}
+
+	return w, nil
+}
+
+func (w *WebhookSink) Name() string {
+	return "webhook " + w.Config.displayName()
+}
+
+// displayName returns the configured name of the webhook, or its redacted URL.
+func (c WebhookConfig) displayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	return RedactURL(c.URL)
+}
+
+// async marks the webhook as delivering in the background, see asyncSink.
+func (w *WebhookSink) async() {}
+
+func (w *WebhookSink) NewCall(call *CallInformation) error {
+	return w.enqueue("newCall", "", call)
+}
+
+func (w *WebhookSink) Answer(call *CallInformation) error {
+	return w.enqueue("answer", "", call)
+}
+
+func (w *WebhookSink) Transfer(call *CallInformation) error {
+	return w.enqueue("transfer", "", call)
+}
+
+func (w *WebhookSink) Hangup(call *CallInformation, outcome CallOutcome) error {
+	return w.enqueue("hangup", string(outcome), call)
+}
+
+// enqueue renders the body for the event and queues it for delivery. It does not wait for the delivery itself.
+func (w *WebhookSink) enqueue(event string, cause string, call *CallInformation) error {
+	if w.events != nil {
+		if _, ok := w.events[event]; !ok {
+			return nil
+		}
+	}
+
+	data := WebhookEvent{
+		Event:       event,
+		Cause:       cause,
+		Time:        time.Now(),
+		RingSeconds: call.RingDuration().Seconds(),
+		TalkSeconds: call.TalkDuration().Seconds(),
+		Call:        *call,
+	}
+
+	var body []byte
+	if w.body == nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("unable to serialize webhook event: %w", err)
+		}
+		body = b
+	} else {
+		var buf bytes.Buffer
+		err := w.body.Execute(&buf, data)
+		if err != nil {
+			return fmt.Errorf("unable to render webhook body: %w", err)
+		}
+		body = buf.Bytes()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	queue, running := w.queues[call.CallUID]
+	w.queues[call.CallUID] = append(queue, webhookDelivery{event: event, body: body})
+	if !running {
+		go w.deliverQueue(call.CallUID)
+	}
+
+	return nil
+}
+
+// deliverQueue sends all queued events of a single call in order, until the queue is empty.
+func (w *WebhookSink) deliverQueue(callUID string) {
+	for {
+		w.mu.Lock()
+		queue := w.queues[callUID]
+		if len(queue) == 0 {
+			delete(w.queues, callUID)
+			w.mu.Unlock()
+			return
+		}
+		delivery := queue[0]
+		w.queues[callUID] = queue[1:]
+		w.mu.Unlock()
+
+		err := w.deliverRetry(delivery)
+		if err != nil {
+			log.Error().Err(err).Str("call_id", callUID).Str("event", delivery.event).Str("webhook", RedactURL(w.Config.URL)).Msg("Giving up on webhook delivery")
+		}
+	}
+}
+
+// deliverRetry sends a single event, retrying with an exponential backoff.
+func (w *WebhookSink) deliverRetry(delivery webhookDelivery) error {
+	backoff := time.Duration(float64(time.Second) * w.Config.RetryBackoff)
+
+	for attempt := 0; ; attempt++ {
+		err := w.deliver(delivery)
+		if err == nil || attempt >= w.maxRetries {
+			return err
+		}
+
+		log.Warn().Err(err).Str("event", delivery.event).Str("webhook", RedactURL(w.Config.URL)).Msgf("Webhook delivery failed - retrying in %s...", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// deliver makes the actual request for a single event.
+func (w *WebhookSink) deliver(delivery webhookDelivery) error {
+	req, err := http.NewRequest(strings.ToUpper(w.Config.Method), w.Config.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return fmt.Errorf("unable to prepare HTTP request: %w", redactError(err))
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %w", redactError(err))
+	}
+	defer resp.Body.Close()
+
+	log.Trace().Str("event", delivery.event).Str("webhook", RedactURL(w.Config.URL)).Int("status", resp.StatusCode).Msg("Webhook response")
+
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response from webhook (HTTP %d): %s", resp.StatusCode, string(data))
+	}
+
+	return nil
+}
@@ -5,6 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -21,46 +25,90 @@ type ZammadApiRequest struct {
 	User            string `json:"user,omitempty"`
 }
 
-// ZammadNewCall notifies Zammad that a new call came in. This is the
+// ZammadClient forwards call events to the CTI endpoint of Zammad.
+type ZammadClient struct {
+	Config *Config
+
+	client http.Client
+
+	// dryRun receives the payloads instead of Zammad, when dry-run mode is enabled.
+	dryRun io.Writer
+
+	// users caches the Zammad logins looked up by extension.
+	users map[string]cachedZammadUser
+
+	// journal records the payloads, if configured.
+	journal *Journal
+
+	// now replaces time.Now in dry-run records, e.g. to replay recorded traffic.
+	now func() time.Time
+}
+
+// zammadDryRunRecord is a single line written in dry-run mode.
+type zammadDryRunRecord struct {
+	Time    time.Time       `json:"time"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// NewZammadClient creates a sink that notifies Zammad about calls.
+func NewZammadClient(config *Config) (*ZammadClient, error) {
+	client, err := config.Zammad.Transport.NewHTTPClient(nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create HTTP client: %w", err)
+	}
+
+	z := &ZammadClient{
+		Config: config,
+		client: client,
+		users:  map[string]cachedZammadUser{},
+	}
+
+	if config.Zammad.DryRun {
+		if config.Zammad.DryRunOutput == "" || config.Zammad.DryRunOutput == "-" {
+			z.dryRun = os.Stdout
+		} else {
+			f, err := os.OpenFile(config.Zammad.DryRunOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+			if err != nil {
+				return nil, fmt.Errorf("unable to open dry-run output: %w", err)
+			}
+			z.dryRun = f
+		}
+
+		log.Warn().Str("output", config.Zammad.DryRunOutput).Msg("Dry-run mode: recording Zammad payloads instead of sending them")
+	} else {
+		log.Debug().Str("endpoint", RedactURL(config.Zammad.Endpoint)).Msg("Sending call events to Zammad")
+	}
+
+	return z, nil
+}
+
+func (z *ZammadClient) Name() string {
+	return "zammad"
+}
+
+// NewCall notifies Zammad that a new call came in. This is the
 // first call required to process calls using Zammad.
-func (z *ZammadBridge) ZammadNewCall(call *CallInformation) error {
-	err := z.ZammadPost(ZammadApiRequest{
+func (z *ZammadClient) NewCall(call *CallInformation) error {
+	return z.Post(ZammadApiRequest{
 		Event:           "newCall",
 		From:            call.CallFrom,
 		To:              call.CallTo,
 		Direction:       call.Direction,
 		CallId:          call.CallUID,
 		AnsweringNumber: call.AgentNumber,
-		User:            call.AgentName,
+		User:            z.userLogin(call),
 	})
-	call.ZammadInitialized = true
-	if err != nil {
-		return err
-	}
-
-	return nil
 }
 
-// ZammadAnswer notifies Zammad that the existing call was now answered by
+// Answer notifies Zammad that the existing call was now answered by
 // an agent.
-func (z *ZammadBridge) ZammadAnswer(call *CallInformation) error {
+func (z *ZammadClient) Answer(call *CallInformation) error {
 	var user string
 	if call.Direction == "Inbound" {
-		user = call.AgentName
+		user = z.userLogin(call)
 	}
 
-	if !call.ZammadInitialized {
-		err := z.ZammadNewCall(call)
-		if err != nil {
-			return fmt.Errorf("unable to initialize call with Zammad: %w", err)
-		}
-	}
-
-	if call.ZammadAnswered {
-		return nil // Nothing to do - TODO: can we redirect the call in Zammad?
-	}
-
-	err := z.ZammadPost(ZammadApiRequest{
+	return z.Post(ZammadApiRequest{
 		Event:           "answer",
 		From:            call.CallFrom,
 		To:              call.CallTo,
@@ -69,38 +117,55 @@ func (z *ZammadBridge) ZammadAnswer(call *CallInformation) error {
 		AnsweringNumber: call.AgentNumber,
 		User:            user,
 	})
-	call.ZammadAnswered = true
-
-	if err != nil {
-		return err
-	}
+}
 
+// Transfer does nothing, because the CTI API of Zammad has no event for calls that move to another agent.
+func (z *ZammadClient) Transfer(_ *CallInformation) error {
 	return nil
 }
 
-// ZammadHangup notifies Zammad that the call was finished with a given cause.
-// Possible values for `cause` are: "cancel", "normalClearing"
-func (z *ZammadBridge) ZammadHangup(call *CallInformation, cause string) error {
-	if !call.ZammadInitialized {
-		err := z.ZammadNewCall(call)
-		if err != nil {
-			return fmt.Errorf("unable to initialize call with Zammad: %w", err)
-		}
-	}
-
-	return z.ZammadPost(ZammadApiRequest{
+// Hangup notifies Zammad that the call was finished. The outcome is reported as a Zammad cause, such as "cancel",
+// "normalClearing", "busy", "noAnswer" or "forwarded", according to the configured hangup_causes.
+func (z *ZammadClient) Hangup(call *CallInformation, outcome CallOutcome) error {
+	return z.Post(ZammadApiRequest{
 		Event:           "hangup",
 		From:            call.CallFrom,
 		To:              call.CallTo,
 		Direction:       call.Direction,
 		CallId:          call.CallUID,
-		Cause:           cause,
+		Cause:           z.hangupCause(outcome),
 		AnsweringNumber: call.AgentNumber,
 	})
 }
 
-// ZammadPost makes a POST Request to Zammad with the given payload
-func (z *ZammadBridge) ZammadPost(payload ZammadApiRequest) error {
+// hangupCause translates the outcome of a call into the cause that is reported to Zammad.
+func (z *ZammadClient) hangupCause(outcome CallOutcome) string {
+	if cause, ok := z.Config.Zammad.HangupCauses[string(outcome)]; ok {
+		return cause
+	}
+
+	if cause, ok := DefaultHangupCauses[outcome]; ok {
+		return cause
+	}
+
+	return "normalClearing"
+}
+
+// setAuthorization adds the configured credentials to the request, if any.
+func (z *ZammadClient) setAuthorization(req *http.Request) {
+	if z.Config.Zammad.Token == "" {
+		return
+	}
+
+	if strings.EqualFold(z.Config.Zammad.TokenType, "token") {
+		req.Header.Set("Authorization", "Token token="+z.Config.Zammad.Token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+z.Config.Zammad.Token)
+	}
+}
+
+// Post makes a POST Request to Zammad with the given payload
+func (z *ZammadClient) Post(payload ZammadApiRequest) error {
 	// Processing
 	if payload.Direction == "Inbound" {
 		payload.Direction = "in"
@@ -116,11 +181,35 @@ func (z *ZammadBridge) ZammadPost(payload ZammadApiRequest) error {
 		return fmt.Errorf("unable to serialize JSON request body: %w", err)
 	}
 
+	err = z.send(payload, requestBody)
+	if z.dryRun != nil {
+		z.journal.Record(JournalKindZammadDryRun, requestBody, err)
+	} else {
+		z.journal.Record(JournalKindZammad, requestBody, err)
+	}
+	return err
+}
+
+// send posts the serialized payload to Zammad, or records it in dry-run mode.
+func (z *ZammadClient) send(payload ZammadApiRequest, requestBody []byte) error {
+	if z.dryRun != nil {
+		return z.record(requestBody)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, z.Config.Zammad.Endpoint, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return fmt.Errorf("unable to prepare HTTP request: %w", redactError(err))
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	z.setAuthorization(req)
+
 	log.Trace().Str("call_id", payload.CallId).Str("event", payload.Event).Str("from", payload.From).Str("to", payload.To).Msg("Zammad request (POST)")
-	resp, err := z.ClientZammad.Post(z.Config.Zammad.Endpoint, "application/json", bytes.NewBuffer(requestBody))
+	resp, err := z.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("unable to make request: %w", err)
+		return fmt.Errorf("unable to make request: %w", redactError(err))
 	}
+	defer resp.Body.Close()
 
 	log.Trace().Str("call_id", payload.CallId).Str("event", payload.Event).Str("from", payload.From).Str("to", payload.To).Int("status", resp.StatusCode).Msg("Zammad response (POST)")
 
@@ -131,3 +220,26 @@ func (z *ZammadBridge) ZammadPost(payload ZammadApiRequest) error {
 
 	return nil
 }
+
+// record writes the payload to the dry-run output, instead of sending it to Zammad.
+func (z *ZammadClient) record(payload []byte) error {
+	now := time.Now
+	if z.now != nil {
+		now = z.now
+	}
+
+	line, err := json.Marshal(zammadDryRunRecord{
+		Time:    now(),
+		Payload: payload,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to serialize dry-run record: %w", err)
+	}
+
+	_, err = z.dryRun.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("unable to write dry-run record: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,232 @@
+package zammadbridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errDryRun is returned instead of making requests to Zammad in dry-run mode.
+var errDryRun = errors.New("dry-run mode: not making requests to Zammad")
+
+// userCacheTTL is how long a resolved Zammad user is remembered, and userMissTTL how long an extension without a user,
+// or whose lookup failed, is remembered. Events are not delayed by looking up the same extension over and over.
+const (
+	userCacheTTL = time.Hour
+	userMissTTL  = time.Minute
+)
+
+// cachedZammadUser is a login resolved from Zammad, which is empty if no user was found or the lookup failed.
+type cachedZammadUser struct {
+	login   string
+	expires time.Time
+}
+
+// apiURL returns the base URL of the Zammad REST API, which defaults to the scheme and host of the CTI endpoint.
+func (z *ZammadClient) apiURL() string {
+	if z.Config.Zammad.ApiURL != "" {
+		return strings.TrimSuffix(z.Config.Zammad.ApiURL, "/")
+	}
+
+	u, err := url.Parse(z.Config.Zammad.Endpoint)
+	if err != nil {
+		return ""
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+// apiRequest makes a request to the Zammad REST API and decodes the JSON response into `response`, if not nil.
+func (z *ZammadClient) apiRequest(method string, path string, body interface{}, response interface{}) error {
+	if z.dryRun != nil {
+		return errDryRun
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("unable to serialize JSON request body: %w", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	// Recordings are attached in the background, while the secrets may be rotated
+	configMu.RLock()
+	apiURL, apiToken := z.apiURL(), z.Config.Zammad.ApiToken
+	configMu.RUnlock()
+
+	req, err := http.NewRequest(method, apiURL+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("unable to prepare HTTP request: %w", redactError(err))
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if apiToken != "" {
+		req.Header.Set("Authorization", "Token token="+apiToken)
+	}
+
+	resp, err := z.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %w", redactError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response from Zammad API (HTTP %d): %s", resp.StatusCode, string(data))
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(response)
+	if err != nil {
+		return fmt.Errorf("unable to parse response JSON: %w", err)
+	}
+
+	return nil
+}
+
+// userLogin returns the Zammad login of the agent of the call. It uses the static mapping of the configuration
+// first, then looks up the extension in Zammad if configured. It falls back to the name of the agent in 3CX.
+func (z *ZammadClient) userLogin(call *CallInformation) string {
+	if login, ok := z.Config.Zammad.Users[call.AgentNumber]; ok {
+		return login
+	}
+
+	// Dry-run mode makes no requests to Zammad at all
+	if z.Config.Zammad.UserLookupAttribute == "" || call.AgentNumber == "" || z.dryRun != nil {
+		return call.AgentName
+	}
+
+	cached, ok := z.users[call.AgentNumber]
+	if !ok || time.Now().After(cached.expires) {
+		login, err := z.lookupUser(call.AgentNumber)
+		if err != nil {
+			log.Warn().Err(err).Str("extension", call.AgentNumber).Msg("Unable to look up Zammad user")
+		}
+
+		ttl := userCacheTTL
+		if login == "" {
+			ttl = userMissTTL
+		}
+
+		cached = cachedZammadUser{login: login, expires: time.Now().Add(ttl)}
+		z.users[call.AgentNumber] = cached
+	}
+
+	if cached.login == "" {
+		return call.AgentName
+	}
+
+	return cached.login
+}
+
+// lookupUser searches Zammad for the user whose configured attribute matches the extension. It returns an empty
+// login when there is no such user.
+func (z *ZammadClient) lookupUser(extension string) (string, error) {
+	attribute := z.Config.Zammad.UserLookupAttribute
+
+	var users []map[string]interface{}
+	err := z.apiRequest(http.MethodGet, "/api/v1/users/search?"+url.Values{
+		"query": {attribute + ":" + extension},
+		"limit": {"10"},
+	}.Encode(), nil, &users)
+	if err != nil {
+		return "", err
+	}
+
+	for _, user := range users {
+		value := strings.TrimSpace(fmt.Sprint(user[attribute]))
+		login, _ := user["login"].(string)
+		if value == extension && login != "" {
+			log.Debug().Str("extension", extension).Str("login", login).Msg("Resolved Zammad user")
+			return login, nil
+		}
+	}
+
+	log.Debug().Str("extension", extension).Msg("No Zammad user found for extension")
+	return "", nil
+}
+
+// zammadAttachment is a file attached to a ticket article.
+type zammadAttachment struct {
+	Filename string `json:"filename"`
+	Data     string `json:"data"`
+	MimeType string `json:"mime-type"`
+}
+
+// findTicketForCaller returns the most recently updated ticket of the customer with the given phone number.
+func (z *ZammadClient) findTicketForCaller(number string) (int, error) {
+	var users []struct {
+		ID int `json:"id"`
+	}
+	err := z.apiRequest(http.MethodGet, "/api/v1/users/search?"+url.Values{
+		"query": {fmt.Sprintf("phone:%q OR mobile:%q", number, number)},
+		"limit": {"1"},
+	}.Encode(), nil, &users)
+	if err != nil {
+		return 0, fmt.Errorf("unable to search for the caller: %w", err)
+	}
+	if len(users) == 0 {
+		return 0, errTicketNotFound
+	}
+
+	var tickets struct {
+		Tickets []int `json:"tickets"`
+	}
+	err = z.apiRequest(http.MethodGet, "/api/v1/tickets/search?"+url.Values{
+		"query":    {fmt.Sprintf("customer_id:%d", users[0].ID)},
+		"sort_by":  {"updated_at"},
+		"order_by": {"desc"},
+		"limit":    {"1"},
+	}.Encode(), nil, &tickets)
+	if err != nil {
+		return 0, fmt.Errorf("unable to search for tickets of the caller: %w", err)
+	}
+	if len(tickets.Tickets) == 0 {
+		return 0, errTicketNotFound
+	}
+
+	return tickets.Tickets[0], nil
+}
+
+// addInternalNote adds an internal note with an optional attachment to the ticket.
+func (z *ZammadClient) addInternalNote(ticketID int, subject string, body string, attachment *zammadAttachment) error {
+	article := struct {
+		TicketID    int                `json:"ticket_id"`
+		Subject     string             `json:"subject"`
+		Body        string             `json:"body"`
+		ContentType string             `json:"content_type"`
+		Type        string             `json:"type"`
+		Internal    bool               `json:"internal"`
+		Attachments []zammadAttachment `json:"attachments,omitempty"`
+	}{
+		TicketID:    ticketID,
+		Subject:     subject,
+		Body:        body,
+		ContentType: "text/html",
+		Type:        "note",
+		Internal:    true,
+	}
+	if attachment != nil {
+		article.Attachments = []zammadAttachment{*attachment}
+	}
+
+	err := z.apiRequest(http.MethodPost, "/api/v1/ticket_articles", article, nil)
+	if err != nil {
+		return fmt.Errorf("unable to add note to ticket %d: %w", ticketID, err)
+	}
+
+	return nil
+}